@@ -0,0 +1,287 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ackTable holds the passings waiting for the acknowledgement of the peer.
+type ackTable struct {
+	m       sync.Mutex
+	seq     uint32
+	waiters map[uint32]chan error
+	err     error // set when the connection is broken
+}
+
+func (t *ackTable) register() (uint32, chan error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	ch := make(chan error, 1)
+	t.seq++
+	if t.err != nil {
+		ch <- t.err
+		return t.seq, ch
+	}
+
+	if t.seq == 0 {
+		t.seq++
+	}
+	if t.waiters == nil {
+		t.waiters = make(map[uint32]chan error)
+	}
+	t.waiters[t.seq] = ch
+	return t.seq, ch
+}
+
+func (t *ackTable) unregister(seq uint32) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.waiters, seq)
+}
+
+// deliver notifies the waiter of seq; an acknowledgement nobody waits for,
+// e.g. one arrived after the timeout, is ignored.
+func (t *ackTable) deliver(seq uint32, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if ch, ok := t.waiters[seq]; ok {
+		ch <- err
+		delete(t.waiters, seq)
+	}
+}
+
+// fail notifies all the waiters that no acknowledgement will arrive.
+func (t *ackTable) fail(err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+	for seq, ch := range t.waiters {
+		ch <- err
+		delete(t.waiters, seq)
+	}
+}
+
+type ackMessage struct {
+	Seq      uint32
+	Accepted bool
+}
+
+func (m *ackMessage) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(m.Seq)
+	bw.write(m.Accepted)
+	return bw.err
+}
+
+func (m *ackMessage) deserialize(r io.Reader) error {
+	br := &bytesReader{r, nil}
+	br.read(&m.Seq)
+	br.read(&m.Accepted)
+	return br.err
+}
+
+// sendAck replies the acknowledgement of the passing seq.
+//
+// Acknowledgements are not subject to the policy nor the limits; they are
+// the replies to the passings already permitted.
+func (c *Conn) sendAck(seq uint32, accepted bool) error {
+	b := bytes.NewBuffer([]byte{byte(AckCommand)})
+	m := ackMessage{Seq: seq, Accepted: accepted}
+	if err := m.serialize(b); err != nil {
+		return err
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	return writeAll(c.conn, b.Bytes())
+}
+
+// receiveAck reads the acknowledgement following AckCommand and delivers it
+// to the waiter.
+func (c *Conn) receiveAck() error {
+	var m ackMessage
+	if err := m.deserialize(c.conn); err != nil {
+		return err
+	}
+
+	if m.Accepted {
+		c.acks.deliver(m.Seq, nil)
+	} else {
+		c.acks.deliver(m.Seq, ErrRefused)
+	}
+	return nil
+}
+
+// SendTCPConnWithAck passes a TCP connection to the peer as SendTCPConn does,
+// and waits until the peer accepts or refuses it with Handoff.
+//
+// conn is closed when the peer accepts it. If the peer refuses it, ErrRefused
+// is returned; if ctx is done before the acknowledgement, the error of ctx is
+// returned. In both cases conn is left open, so that it can be passed to
+// another peer. The deadline of ctx is told to the peer; see Handoff.Accept.
+//
+// The peer stops accepting a little before the deadline, so that its
+// acceptance arrives in time. An acceptance arriving after ctx is done is
+// still ignored; the connection may then be served by both processes if it is
+// passed again, so the deadline should leave room for scheduling delays.
+//
+// The acknowledgement is read by ReceiveCommand; another goroutine must be
+// receiving commands from c while SendTCPConnWithAck waits.
+func (c *Conn) SendTCPConnWithAck(ctx context.Context, conn *net.TCPConn, peeked, msg []byte) error {
+	seq, ch, err := c.sendHandoff(ctx, conn, peeked, msg)
+	if err != nil {
+		return err
+	}
+	return c.waitHandoff(ctx, conn, seq, ch)
+}
+
+// sendHandoff is the sending half of SendTCPConnWithAck; the caller must call
+// waitHandoff if it succeeds.
+func (c *Conn) sendHandoff(ctx context.Context, conn net.Conn, peeked, msg []byte) (uint32, chan error, error) {
+	if err := c.checkAccess(AccessReceive, TCPConnCommand); err != nil {
+		return 0, nil, err
+	}
+	if err := c.acquire(true); err != nil {
+		return 0, nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, nil, context.DeadlineExceeded
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	seq, ch := c.acks.register()
+	buf := [1]byte{byte(TCPConnCommand)}
+	if _, err := c.conn.Write(buf[:]); err != nil {
+		c.acks.unregister(seq)
+		return 0, nil, err
+	}
+	if err := c.socketGW.send(c.conn, conn, peeked, msg, seq, deadline); err != nil {
+		c.acks.unregister(seq)
+		return 0, nil, err
+	}
+	return seq, ch, nil
+}
+
+func (c *Conn) waitHandoff(ctx context.Context, conn net.Conn, seq uint32, ch chan error) error {
+	var err error
+	select {
+	case err = <-ch:
+		c.acks.unregister(seq)
+	case <-ctx.Done():
+		// an acknowledgement delivered until the unregistering is taken;
+		// the later ones are ignored
+		c.acks.unregister(seq)
+		select {
+		case err = <-ch:
+		default:
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// handoffAckMargin is the time for an acceptance to reach the sender before
+// the deadline.
+const handoffAckMargin = 10 * time.Millisecond
+
+// Handoff is the acknowledgement request of a TCP connection passed by
+// SendTCPConnWithAck. The receiver must call either Accept or Refuse once.
+//
+// Accept and Refuse write to the IPC connection; like the Send methods, they
+// can be called concurrently with other writes to the connection.
+type Handoff struct {
+	c        *Conn
+	conn     TCPConn
+	seq      uint32
+	deadline time.Time
+	done     bool
+}
+
+// Deadline returns the time until Accept can be called. It is a little before
+// the sender stops waiting for the acknowledgement, and zero if the sender
+// waits forever.
+func (h *Handoff) Deadline() time.Time {
+	return h.deadline
+}
+
+// Accept tells the sender that the connection is taken over; the sender
+// closes its copy.
+//
+// If the deadline has passed, the sender may have passed the connection to
+// another peer; Accept closes the connection and returns ErrHandoffExpired.
+func (h *Handoff) Accept() error {
+	if h.done {
+		return nil
+	}
+	h.done = true
+
+	if !h.deadline.IsZero() && time.Now().After(h.deadline) {
+		h.conn.Close()
+		h.c.sendAck(h.seq, false)
+		return ErrHandoffExpired
+	}
+	return h.c.sendAck(h.seq, true)
+}
+
+// Refuse closes the connection and tells the sender to keep it. The client is
+// not disconnected since the sender still holds the connection.
+func (h *Handoff) Refuse() error {
+	if h.done {
+		return nil
+	}
+	h.done = true
+
+	h.conn.Close()
+	return h.c.sendAck(h.seq, false)
+}
+
+// ReceiveTCPConnWithAck is like ReceiveTCPConn but lets the receiver accept
+// or refuse the connection with the returned Handoff. The Handoff is nil if
+// the peer passed the connection with SendTCPConn, i.e. requested no
+// acknowledgement.
+//
+// See also SendTCPConnWithAck.
+func (c *Conn) ReceiveTCPConnWithAck() (TCPConn, *Handoff, bool, error) {
+	sock, sd, err := c.socketGW.receive(c.conn)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	info := &ConnInfo{
+		SentAt:     sd.sentAt,
+		ReceivedAt: time.Now(),
+		LocalAddr:  sd.laddr,
+		RemoteAddr: sd.raddr,
+	}
+	if p, err := c.Peer(); err == nil {
+		info.SenderPID = p.PID
+	}
+	conn := newTCPConn(sock, sd.laddr, sd.raddr, sd.peeked, info)
+	if sd.ackSeq == 0 {
+		return conn, nil, sd.withData, nil
+	}
+
+	h := &Handoff{c: c, conn: conn, seq: sd.ackSeq}
+	if sd.ackTime > 0 {
+		// the deadline of the sender, not affected by the time the
+		// connection waited in the socket
+		h.deadline = sd.sentAt.Add(sd.ackTime - handoffAckMargin)
+	}
+	return conn, h, sd.withData, nil
+}
@@ -0,0 +1,105 @@
+package ipc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSendTCPConnWithAck(t *testing.T) {
+	sender, receiver := connPair(t, "a")
+	defer sender.Close()
+	defer receiver.Close()
+
+	// acknowledgements are read by ReceiveCommand
+	go sender.ReceiveCommand()
+
+	var tests = []struct {
+		name   string
+		answer func(h *Handoff) error
+		want   error
+	}{
+		{"accept", (*Handoff).Accept, nil},
+		{"refuse", (*Handoff).Refuse, ErrRefused},
+		{"timeout", func(h *Handoff) error {
+			time.Sleep(time.Until(h.Deadline()) + 10*time.Millisecond)
+			if err := h.Accept(); err != ErrHandoffExpired {
+				t.Errorf("Accept returned `%v` but want `%v`", err, ErrHandoffExpired)
+			}
+			return nil
+		}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := tcpPair(t)
+			defer server.Close()
+			defer client.Close()
+
+			done := make(chan error)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				done <- sender.SendTCPConnWithAck(ctx, server, nil, nil)
+			}()
+
+			if cmd, err := receiver.ReceiveCommand(); err != nil || cmd != TCPConnCommand {
+				t.Fatalf("ReceiveCommand returned %v, %v", cmd, err)
+			}
+			conn, h, _, err := receiver.ReceiveTCPConnWithAck()
+			if err != nil {
+				t.Fatalf("ReceiveTCPConnWithAck error: %v", err)
+			}
+			defer conn.Close()
+			if h == nil {
+				t.Fatal("no acknowledgement is requested")
+			}
+			if err := tt.answer(h); err != nil {
+				t.Fatalf("answer error: %v", err)
+			}
+
+			if got := <-done; got != tt.want {
+				t.Errorf("SendTCPConnWithAck returned `%v` but want `%v`", got, tt.want)
+			}
+
+			// the sender keeps the connection unless accepted
+			_, err = server.Write([]byte("x"))
+			if closed := err != nil; closed != (tt.want == nil) {
+				t.Errorf("got write error `%v` after %s", err, tt.name)
+			}
+		})
+	}
+
+	// the deadline of the receiver is not extended by the time the
+	// connection waited in the socket; both sides agree on the result
+	for _, delay := range []time.Duration{80 * time.Millisecond, 95 * time.Millisecond} {
+		t.Run("late receiver "+delay.String(), func(t *testing.T) {
+			server, client := tcpPair(t)
+			defer server.Close()
+			defer client.Close()
+
+			done := make(chan error)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				done <- sender.SendTCPConnWithAck(ctx, server, nil, nil)
+			}()
+
+			time.Sleep(delay)
+			if cmd, err := receiver.ReceiveCommand(); err != nil || cmd != TCPConnCommand {
+				t.Fatalf("ReceiveCommand returned %v, %v", cmd, err)
+			}
+			conn, h, _, err := receiver.ReceiveTCPConnWithAck()
+			if err != nil {
+				t.Fatalf("ReceiveTCPConnWithAck error: %v", err)
+			}
+			defer conn.Close()
+			// accept at the last moment
+			time.Sleep(time.Until(h.Deadline()) - 2*time.Millisecond)
+			accepted := h.Accept() == nil
+
+			if err := <-done; (err == nil) != accepted {
+				t.Errorf("SendTCPConnWithAck returned `%v` but Accept %v", err, accepted)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var activation struct {
+	once    sync.Once
+	files   []*os.File
+	err     error
+	m       sync.Mutex   // guard below
+	n       int          // number of files, set after the first call
+	claimed map[int]bool // descriptors taken by Listen
+}
+
+// ActivationFiles returns the descriptors passed by systemd socket
+// activation, named after LISTEN_FDNAMES, or "unknown" if not named. It
+// returns nil if the process is not socket activated, i.e. LISTEN_PID is not
+// the process.
+//
+// The environment variables are unset on the first call so that they are not
+// inherited by the children of the process; the later calls return the same
+// files.
+func ActivationFiles() ([]*os.File, error) {
+	activation.once.Do(func() {
+		activation.files, activation.err = activationFiles()
+		activation.m.Lock()
+		activation.n = len(activation.files)
+		activation.m.Unlock()
+	})
+	return activation.files, activation.err
+}
+
+// ActivationListeners returns the listening sockets among ActivationFiles,
+// keyed by name. The sockets of the same name are in the order passed. The
+// listeners are duplicates of the files; closing them does not close the
+// files.
+func ActivationListeners() (map[string][]net.Listener, error) {
+	files, err := ActivationFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	ls := make(map[string][]net.Listener)
+	for _, f := range files {
+		if !isListening(f) {
+			continue
+		}
+		l, err := net.FileListener(f)
+		if err != nil {
+			for _, v := range ls {
+				for _, l := range v {
+					l.Close()
+				}
+			}
+			return nil, err
+		}
+		ls[f.Name()] = append(ls[f.Name()], l)
+	}
+	return ls, nil
+}
+
+// ActivationIPCListeners returns the IPC listeners among ActivationListeners,
+// i.e. the listening unix stream sockets.
+//
+// Listen also returns an activated socket whose path is the pipe name, so
+// that the socket can be activated without changes of the code. Listen does
+// not unset the environment variables, nor take the descriptors; it uses a
+// duplicate, so that ActivationFiles or another library can still use them.
+func ActivationIPCListeners() (map[string][]*Listener, error) {
+	ls, err := ActivationListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	ipcls := make(map[string][]*Listener)
+	for name, v := range ls {
+		for _, l := range v {
+			if _, ok := l.(*net.UnixListener); ok {
+				ipcls[name] = append(ipcls[name], &Listener{l: l})
+			} else {
+				l.Close()
+			}
+		}
+	}
+	return ipcls, nil
+}
+
+// NamedFD is a descriptor passed to a socket activated process by
+// StartActivated.
+type NamedFD struct {
+	// Name is set to LISTEN_FDNAMES; it must not contain ':'.
+	Name string
+
+	// FD is the descriptor to pass, e.g. a *net.TCPListener, a
+	// *net.UnixListener, a TCPConn or an *os.File. It is left open.
+	FD syscall.Conn
+}
+
+// StartActivated starts cmd as a process activated by systemd socket
+// activation: fds are placed at the descriptors from 3 in order, preceding
+// cmd.ExtraFiles, and LISTEN_FDS, LISTEN_FDNAMES and LISTEN_PID are set. If
+// cmd.Env is nil, the environment of the process is used.
+//
+// Since LISTEN_PID must be the pid of cmd, which is not known before the
+// start, cmd is started through /bin/sh, which sets its own pid and then
+// executes cmd.Path; cmd.Args[0] is not given to the process.
+//
+// The descriptors are duplicates sharing the file status flags with fds, so
+// the listeners of the net package are passed non-blocking. O_NONBLOCK is not
+// cleared for the process since it would make fds blocking in this process
+// too; a process accepting with blocking calls should clear it by itself once
+// this process stops using fds.
+//
+// It is not supported on windows.
+func StartActivated(cmd *exec.Cmd, fds []NamedFD) error {
+	names := make([]string, len(fds))
+	for i, fd := range fds {
+		if strings.Contains(fd.Name, ":") {
+			return fmt.Errorf("invalid name %q", fd.Name)
+		}
+		names[i] = fd.Name
+	}
+	return startActivated(cmd, fds, strings.Join(names, ":"))
+}
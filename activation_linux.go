@@ -0,0 +1,204 @@
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFdsStart is the first descriptor passed by socket activation.
+const listenFdsStart = 3
+
+func activationFiles() ([]*os.File, error) {
+	pid, pidSet := os.LookupEnv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if !pidSet || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var nameList []string
+	if names != "" {
+		nameList = strings.Split(names, ":")
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFdsStart + i
+		unix.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
+
+// activatedUnixListener returns the activated unix stream socket bound to the
+// path name, or nil. A socket is returned only once.
+func activatedUnixListener(name string) net.Listener {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil
+	}
+
+	activation.m.Lock()
+	defer activation.m.Unlock()
+
+	for _, fd := range activatedFds() {
+		if activation.claimed[fd] {
+			continue
+		}
+		v, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+		if err != nil || v != 1 {
+			continue
+		}
+		sa, _ := unix.Getsockname(fd)
+		if ua, ok := sa.(*unix.SockaddrUnix); !ok || ua.Name != path {
+			continue
+		}
+
+		// the descriptor is left to its owner
+		dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		f := os.NewFile(uintptr(dup), path)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if activation.claimed == nil {
+			activation.claimed = make(map[int]bool)
+		}
+		activation.claimed[fd] = true
+		return l
+	}
+	return nil
+}
+
+// activatedFds returns the activated descriptors. The environment variables
+// are read without unsetting them; if ActivationFiles has unset them, its
+// files are used. activation.m must be held.
+func activatedFds() []int {
+	n := activation.n
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		v, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || v < 0 {
+			return nil
+		}
+		n = v
+	}
+
+	fds := make([]int, n)
+	for i := range fds {
+		fds[i] = listenFdsStart + i
+	}
+	return fds
+}
+
+func isListening(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var v int
+	cerr := rc.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	})
+	return cerr == nil && err == nil && v == 1
+}
+
+// fixupPIDScript sets LISTEN_PID to the pid of the shell, which is kept by
+// exec.
+const fixupPIDScript = `LISTEN_PID=$$; export LISTEN_PID; exec "$0" "$@"`
+
+func startActivated(cmd *exec.Cmd, fds []NamedFD, names string) error {
+	files := make([]*os.File, 0, len(fds))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, fd := range fds {
+		f, err := dupFile(fd.FD, fd.Name)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = make([]string, 0, len(env)+2)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "LISTEN_PID=") &&
+			!strings.HasPrefix(kv, "LISTEN_FDS=") &&
+			!strings.HasPrefix(kv, "LISTEN_FDNAMES=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(fds)),
+		"LISTEN_FDNAMES="+names,
+	)
+	cmd.ExtraFiles = append(files[:len(files):len(files)], cmd.ExtraFiles...)
+
+	path := cmd.Path
+	var args []string
+	if len(cmd.Args) > 1 {
+		args = cmd.Args[1:]
+	}
+	cmd.Path = "/bin/sh"
+	cmd.Args = append([]string{"sh", "-c", fixupPIDScript, path}, args...)
+	return cmd.Start()
+}
+
+// dupFile duplicates the descriptor of sc.
+func dupFile(sc syscall.Conn, name string) (*os.File, error) {
+	fd, err := dupFd(sc)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// dupFd duplicates the descriptor of sc as a close-on-exec descriptor. Fd of
+// os.File is not used since it makes the descriptor blocking; the duplicate
+// shares O_NONBLOCK with sc.
+func dupFd(sc syscall.Conn) (int, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var fd int
+	cerr := rc.Control(func(v uintptr) {
+		fd, err = unix.Dup(int(v))
+	})
+	if cerr != nil {
+		return -1, cerr
+	}
+	if err != nil {
+		return -1, os.NewSyscallError("dup", err)
+	}
+	unix.CloseOnExec(fd)
+	return fd, nil
+}
@@ -0,0 +1,184 @@
+package ipc
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const activationChildEnv = "GO_IPC_TEST_ACTIVATION_CHILD"
+
+// TestActivationChild is the socket activated process started by
+// TestActivation.
+func TestActivationChild(t *testing.T) {
+	path := os.Getenv(activationChildEnv)
+	if path == "" {
+		t.Skip("run by TestActivation")
+	}
+	if _, ok := os.LookupEnv("LISTEN_PID"); !ok {
+		// started without StartActivated
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	} else {
+		// the status flags are shared with the listener of the parent
+		fl, err := unix.FcntlInt(listenFdsStart, unix.F_GETFL, 0)
+		if err != nil {
+			t.Fatalf("fcntl error: %v", err)
+		}
+		if fl&unix.O_NONBLOCK == 0 {
+			t.Errorf("got blocking listener but want non-blocking: flags %#o", fl)
+		}
+	}
+
+	// Listen leaves the environment to ActivationFiles
+	other, err := Listen(path + ".other")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	other.Close()
+	if _, ok := os.LookupEnv("LISTEN_FDS"); !ok {
+		t.Error("LISTEN_FDS unset by Listen")
+	}
+
+	files, err := ActivationFiles()
+	if err != nil {
+		t.Fatalf("ActivationFiles error: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 3 || names[0] != "web" || names[1] != "ipc" || names[2] != "unknown" {
+		t.Errorf("got names %v", names)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Error("LISTEN_FDS not unset")
+	}
+
+	ls, err := ActivationListeners()
+	if err != nil {
+		t.Fatalf("ActivationListeners error: %v", err)
+	}
+	if len(ls["web"]) != 1 || len(ls["ipc"]) != 1 || len(ls["unknown"]) != 0 {
+		t.Fatalf("got listeners %v", ls)
+	}
+	ipcls, err := ActivationIPCListeners()
+	if err != nil {
+		t.Fatalf("ActivationIPCListeners error: %v", err)
+	}
+	if len(ipcls["ipc"]) != 1 || len(ipcls["web"]) != 0 {
+		t.Errorf("got IPC listeners %v", ipcls)
+	}
+
+	c, err := ls["web"][0].Accept()
+	if err != nil {
+		t.Fatalf("Accept error: %v", err)
+	}
+	c.Write([]byte("web\n"))
+	c.Close()
+
+	// the socket file exists; Listen succeeds only with the activated one
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error: %v", err)
+	}
+	conn.SendData([]byte("ipc"))
+	conn.Close()
+}
+
+func TestActivation(t *testing.T) {
+	t.Run("env set by hand", func(t *testing.T) {
+		testActivation(t, func(cmd *exec.Cmd, tl, ul net.Listener, pr *os.File) error {
+			tf, _ := tl.(*net.TCPListener).File()
+			defer tf.Close()
+			uf, _ := ul.(*net.UnixListener).File()
+			defer uf.Close()
+
+			cmd.Env = append(cmd.Env, "LISTEN_FDS=3", "LISTEN_FDNAMES=web:ipc")
+			cmd.ExtraFiles = []*os.File{tf, uf, pr}
+			return cmd.Start()
+		})
+	})
+
+	t.Run("StartActivated", func(t *testing.T) {
+		testActivation(t, func(cmd *exec.Cmd, tl, ul net.Listener, pr *os.File) error {
+			// a stale value is replaced
+			cmd.Env = append(cmd.Env, "LISTEN_PID=1")
+			return StartActivated(cmd, []NamedFD{
+				{Name: "web", FD: tl.(*net.TCPListener)},
+				{Name: "ipc", FD: ul.(*net.UnixListener)},
+				{FD: pr},
+			})
+		})
+	})
+}
+
+func testActivation(t *testing.T, start func(cmd *exec.Cmd, tl, ul net.Listener, pr *os.File) error) {
+	dir, err := ioutil.TempDir("", "go-ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipc.sock")
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	ul, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationChild$")
+	cmd.Env = append(os.Environ(), activationChildEnv+"="+path)
+	cmd.Stderr = os.Stderr
+	if err := start(cmd, tl, ul, pr); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+
+	c, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "web\n" {
+		t.Errorf("got %q, error `%v`", line, err)
+	}
+
+	conn, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ReceiveCommand(); err != nil {
+		t.Fatalf("ReceiveCommand error: %v", err)
+	}
+	if data, err := conn.ReceiveData(); err != nil || string(data) != "ipc" {
+		t.Errorf("got %q, error `%v`", data, err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("child error: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package ipc
+
+import (
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer selects a worker to pass a client connection; see
+// Dispatcher.Balancer.
+type Balancer interface {
+	// Pick returns one of workers to pass the connection from client.
+	// peeked is the data peeked from the connection. workers is never empty.
+	// Pick may return nil to refuse the connection.
+	Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker
+}
+
+// RoundRobin returns a Balancer which selects workers in turn. It is the
+// default Balancer of Dispatcher.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (b *roundRobin) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	n := atomic.AddUint32(&b.next, 1) - 1
+	return workers[int(n%uint32(len(workers)))]
+}
+
+// LeastLoad returns a Balancer which selects the worker with the least
+// outstanding connections. See Worker.Load.
+func LeastLoad() Balancer {
+	return leastLoad{}
+}
+
+type leastLoad struct{}
+
+func (leastLoad) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	best := workers[0]
+	bestLoad := best.Load()
+	for _, w := range workers[1:] {
+		if l := w.Load(); l < bestLoad {
+			best, bestLoad = w, l
+		}
+	}
+	return best
+}
+
+// RandomTwoChoices returns a Balancer which selects two workers at random
+// and takes the one with less outstanding connections.
+func RandomTwoChoices() Balancer {
+	return &randomTwoChoices{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+type randomTwoChoices struct {
+	m   sync.Mutex // guard rnd
+	rnd *rand.Rand
+}
+
+func (b *randomTwoChoices) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	if len(workers) == 1 {
+		return workers[0]
+	}
+
+	b.m.Lock()
+	i := b.rnd.Intn(len(workers))
+	j := b.rnd.Intn(len(workers) - 1)
+	b.m.Unlock()
+	if j >= i {
+		j++
+	}
+
+	if workers[j].Load() < workers[i].Load() {
+		return workers[j]
+	}
+	return workers[i]
+}
+
+// Weighted returns a Balancer which selects workers in proportion to their
+// weights with the smooth weighted round-robin. See Worker.SetWeight.
+func Weighted() Balancer {
+	return &weighted{current: make(map[*Worker]int)}
+}
+
+type weighted struct {
+	m       sync.Mutex // guard current
+	current map[*Worker]int
+}
+
+func (b *weighted) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for w := range b.current {
+		if w.isRemoved() {
+			delete(b.current, w)
+		}
+	}
+
+	// workers left out, e.g. excluded on a retry, keep their state
+	var best *Worker
+	total := 0
+	for _, w := range workers {
+		weight := w.Weight()
+		total += weight
+		b.current[w] += weight
+		if best == nil || b.current[w] > b.current[best] {
+			best = w
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// ConsistentHash returns a Balancer which selects a worker by the hash of the
+// client IP address, and the port if withPort is true. A client keeps being
+// passed to the same worker while the set of the workers is unchanged, and
+// only clients of a removed or added worker move.
+//
+// Workers are placed on the hash ring by their names; see Worker.SetName.
+func ConsistentHash(withPort bool) Balancer {
+	return &consistentHash{withPort: withPort}
+}
+
+// hashReplicas is the number of points of a worker on the hash ring.
+const hashReplicas = 100
+
+type hashPoint struct {
+	hash   uint32
+	worker *Worker
+}
+
+type consistentHash struct {
+	withPort bool
+
+	m       sync.Mutex // guard below
+	workers []*Worker  // workers on the ring
+	ring    []hashPoint
+}
+
+func (b *consistentHash) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	h := fnv.New32a()
+	h.Write(client.IP)
+	if b.withPort {
+		io.WriteString(h, strconv.Itoa(client.Port))
+	}
+	key := h.Sum32()
+
+	// walk the ring from the key, skipping workers left out of workers, e.g.
+	// excluded on a retry; the ring itself keeps them
+	ring := b.ringOf(workers)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= key })
+	for n := 0; n < len(ring); n++ {
+		p := ring[(i+n)%len(ring)]
+		if containsWorker(workers, p.worker) {
+			return p.worker
+		}
+	}
+	return workers[0]
+}
+
+// ringOf returns the hash ring containing workers; it is rebuilt only when a
+// worker is added or removed.
+func (b *consistentHash) ringOf(workers []*Worker) []hashPoint {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	var all []*Worker
+	changed := false
+	for _, w := range b.workers {
+		if w.isRemoved() {
+			changed = true
+		} else {
+			all = append(all, w)
+		}
+	}
+	for _, w := range workers {
+		if !containsWorker(all, w) {
+			all = append(all, w)
+			changed = true
+		}
+	}
+	if !changed {
+		return b.ring
+	}
+
+	ring := make([]hashPoint, 0, len(all)*hashReplicas)
+	for _, w := range all {
+		name := w.Name()
+		for i := 0; i < hashReplicas; i++ {
+			h := fnv.New32a()
+			io.WriteString(h, strconv.Itoa(i)+"-"+name)
+			ring = append(ring, hashPoint{h.Sum32(), w})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	b.workers = all
+	b.ring = ring
+	return ring
+}
+
+// ReportLoad reports the number of outstanding connections of this worker to
+// the Dispatcher through c; it is used by LeastLoad and RandomTwoChoices.
+func ReportLoad(c *Conn, outstanding int) error {
+	return c.sendMessage(&workerMessage{Kind: workerLoad, Value: int64(outstanding)})
+}
+
+// Kinds of workerMessage.
+const (
+	workerLoad = iota + 1
+	workerReady
+)
+
+// workerMessage is a message sent from a worker to the Dispatcher.
+type workerMessage struct {
+	Kind  uint8
+	Value int64
+}
+
+func (m *workerMessage) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(m.Kind)
+	bw.write(m.Value)
+	return bw.err
+}
+
+func (m *workerMessage) deserialize(r io.Reader) error {
+	br := &bytesReader{r, nil}
+	br.read(&m.Kind)
+	br.read(&m.Value)
+	return br.err
+}
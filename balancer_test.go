@@ -0,0 +1,125 @@
+package ipc
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestingWorkers(n int) []*Worker {
+	ws := make([]*Worker, n)
+	for i := range ws {
+		ws[i] = &Worker{id: i + 1, weight: 1}
+	}
+	return ws
+}
+
+func TestBalancer(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		ws := newTestingWorkers(3)
+		b := RoundRobin()
+		for i := 0; i < 6; i++ {
+			if got, want := b.Pick(ws, client, nil), ws[i%3]; got != want {
+				t.Errorf("#%d: got worker %v but want %v", i, got.Name(), want.Name())
+			}
+		}
+	})
+
+	t.Run("LeastLoad", func(t *testing.T) {
+		ws := newTestingWorkers(3)
+		ws[0].setReportedLoad(5)
+		ws[1].setReportedLoad(2)
+		ws[2].setReportedLoad(3)
+		b := LeastLoad()
+		if got, want := b.Pick(ws, client, nil), ws[1]; got != want {
+			t.Errorf("got worker %v but want %v", got.Name(), want.Name())
+		}
+	})
+
+	t.Run("RandomTwoChoices", func(t *testing.T) {
+		ws := newTestingWorkers(2)
+		ws[0].setReportedLoad(10)
+		b := RandomTwoChoices()
+		for i := 0; i < 10; i++ {
+			if got, want := b.Pick(ws, client, nil), ws[1]; got != want {
+				t.Errorf("got worker %v but want %v", got.Name(), want.Name())
+			}
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		ws := newTestingWorkers(3)
+		ws[0].SetWeight(5)
+		b := Weighted()
+		count := map[*Worker]int{}
+		for i := 0; i < 70; i++ {
+			count[b.Pick(ws, client, nil)]++
+		}
+		if count[ws[0]] != 50 || count[ws[1]] != 10 || count[ws[2]] != 10 {
+			t.Errorf("not distributed by the weights: %v, %v, %v", count[ws[0]], count[ws[1]], count[ws[2]])
+		}
+
+		// a retry without ws[0] keeps its state
+		wb := b.(*weighted)
+		b.Pick(ws, client, nil)
+		before := wb.current[ws[0]]
+		b.Pick(ws[1:], client, nil)
+		if got := wb.current[ws[0]]; got != before {
+			t.Errorf("state of the excluded worker changed from %v to %v", before, got)
+		}
+
+		atomic.StoreInt32(&ws[0].removed, 1)
+		b.Pick(ws[1:], client, nil)
+		if _, ok := wb.current[ws[0]]; ok {
+			t.Errorf("state of the removed worker is kept")
+		}
+	})
+
+	t.Run("ConsistentHash", func(t *testing.T) {
+		ws := newTestingWorkers(4)
+		b := ConsistentHash(false)
+
+		clients := make([]*net.TCPAddr, 100)
+		picked := make([]*Worker, len(clients))
+		for i := range clients {
+			clients[i] = &net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i)), Port: i}
+			picked[i] = b.Pick(ws, clients[i], nil)
+		}
+
+		// sticky
+		for i, c := range clients {
+			again := b.Pick(ws, &net.TCPAddr{IP: c.IP, Port: c.Port + 1}, nil)
+			if again != picked[i] {
+				t.Errorf("client %v moved from %v to %v", c, picked[i].Name(), again.Name())
+			}
+		}
+
+		// only clients of the removed worker move
+		for i, c := range clients {
+			got := b.Pick(ws[:3], c, nil)
+			if picked[i] != ws[3] && got != picked[i] {
+				t.Errorf("client %v moved from %v to %v", c, picked[i].Name(), got.Name())
+			}
+		}
+
+		// the retries above kept ws[3] on the ring
+		ring := b.(*consistentHash).ring
+		if got, want := len(ring), 4*hashReplicas; got != want {
+			t.Errorf("got %v points on the ring but want %v", got, want)
+		}
+		for i, c := range clients {
+			if got := b.Pick(ws, c, nil); got != picked[i] {
+				t.Errorf("client %v moved from %v to %v", c, picked[i].Name(), got.Name())
+			}
+		}
+
+		atomic.StoreInt32(&ws[3].removed, 1)
+		b.Pick(ws[:3], clients[0], nil)
+		ring = b.(*consistentHash).ring
+		if got, want := len(ring), 3*hashReplicas; got != want {
+			t.Errorf("got %v points on the ring but want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,276 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// BindRule permits peers to bind addresses.
+//
+// Network is "tcp" or "udp"; it also matches "tcp4", "tcp6", "udp4" and
+// "udp6". Hosts is the list of hosts the address may have, such as
+// "127.0.0.1", "::1" or "" for all interfaces; IP addresses are compared as
+// IPs, and any host is permitted if it is empty. The port must be within
+// MinPort and MaxPort; port 0 asks the system for an ephemeral port. ReusePort
+// permits SO_REUSEPORT. UID restricts the rule to the peer with the uid; set it
+// with ID, or leave it nil to match any peer.
+type BindRule struct {
+	Network   string
+	Hosts     []string
+	MinPort   int
+	MaxPort   int
+	ReusePort bool
+	UID       *int
+}
+
+func (r *BindRule) permits(p *Peer, req *bindRequest, host string, port int) bool {
+	if r.UID != nil && *r.UID != p.UID {
+		return false
+	}
+	if !strings.HasPrefix(req.Network, r.Network) {
+		return false
+	}
+	if !r.permitsHost(host) {
+		return false
+	}
+	if req.ReusePort && !r.ReusePort {
+		return false
+	}
+	return r.MinPort <= port && port <= r.MaxPort
+}
+
+func (r *BindRule) permitsHost(host string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	for _, h := range r.Hosts {
+		if h == host {
+			return true
+		}
+		if ip != nil && ip.Equal(net.ParseIP(h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Binder binds TCP and UDP addresses on behalf of unprivileged peers, and
+// passes the bound sockets to them. The peers can use ports below 1024 without
+// CAP_NET_BIND_SERVICE.
+//
+// A peer sends a bind request with BinderClient. The binder checks it against
+// Rules and replies with the listener via SendListener or SendPacketConn, or
+// with a BindError. A request is permitted if any rule permits it.
+//
+// It is not supported on windows; listeners can not be passed.
+type Binder struct {
+	Rules []BindRule
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine.
+// It returns when Accept fails, e.g. l was closed.
+func (b *Binder) Serve(l *Listener) error {
+	return serveConns(l, b.ServeConn)
+}
+
+// ServeConn serves bind requests on c until the peer closes the connection or
+// an error occurs. The connection is not closed by ServeConn.
+func (b *Binder) ServeConn(c *Conn) error {
+	for {
+		var req bindRequest
+		if err := c.receiveRequest("binder", &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := b.bind(c, &req); err != nil {
+			if err := c.sendError(err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// bind binds the requested address and sends it to the peer. It returns an
+// error to be sent to the peer.
+func (b *Binder) bind(c *Conn, req *bindRequest) error {
+	p, err := c.Peer()
+	if err != nil {
+		return err
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return err
+	}
+	port, err := net.LookupPort(req.Network, portStr)
+	if err != nil {
+		return err
+	}
+
+	permitted := false
+	for i := range b.Rules {
+		if b.Rules[i].permits(p, req, host, port) {
+			permitted = true
+			break
+		}
+	}
+	if !permitted {
+		return ErrNotPermitted
+	}
+
+	lc := net.ListenConfig{}
+	if req.ReusePort {
+		lc.Control = reusePortControl
+	}
+
+	switch req.Network {
+	case "tcp", "tcp4", "tcp6":
+		l, err := lc.Listen(context.Background(), req.Network, req.Address)
+		if err != nil {
+			return err
+		}
+		if err := c.SendListener(l, nil); err != nil {
+			l.Close()
+			return err
+		}
+	case "udp", "udp4", "udp6":
+		pc, err := lc.ListenPacket(context.Background(), req.Network, req.Address)
+		if err != nil {
+			return err
+		}
+		if err := c.SendPacketConn(pc, nil); err != nil {
+			pc.Close()
+			return err
+		}
+	default:
+		return net.UnknownNetworkError(req.Network)
+	}
+	return nil
+}
+
+// BindError is returned by BinderClient when the binder did not bind the
+// address.
+//
+// Err is ErrNotPermitted if the binder rules denied the request. Otherwise it
+// is an error with the message of the binder.
+type BindError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *BindError) Error() string {
+	return "binder: listen " + e.Network + " " + e.Address + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *BindError) Unwrap() error {
+	return e.Err
+}
+
+// BinderClient sends bind requests to a Binder. It is safe for concurrent use.
+type BinderClient struct {
+	conn *Conn
+	m    sync.Mutex // guard conn
+}
+
+// NewBinderClient creates a BinderClient using the connection to a Binder.
+func NewBinderClient(c *Conn) *BinderClient {
+	return &BinderClient{conn: c}
+}
+
+// Listen asks the binder to listen on the TCP address like net.Listen. If
+// reusePort is true, SO_REUSEPORT is set to the socket so that other listeners
+// can bind the same address.
+//
+// If the binder refuses or fails, the error is a *BindError.
+func (bc *BinderClient) Listen(network, address string, reusePort bool) (net.Listener, error) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+
+	cmd, err := bc.request(network, address, reusePort)
+	if err != nil {
+		return nil, err
+	}
+	if cmd != ListenerCommand {
+		return nil, fmt.Errorf("binder: unexpected command %v", cmd)
+	}
+	l, _, err := bc.conn.ReceiveListener()
+	return l, err
+}
+
+// ListenPacket asks the binder to listen on the UDP address like
+// net.ListenPacket. reusePort is same as Listen.
+//
+// If the binder refuses or fails, the error is a *BindError.
+func (bc *BinderClient) ListenPacket(network, address string, reusePort bool) (net.PacketConn, error) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+
+	cmd, err := bc.request(network, address, reusePort)
+	if err != nil {
+		return nil, err
+	}
+	if cmd != PacketConnCommand {
+		return nil, fmt.Errorf("binder: unexpected command %v", cmd)
+	}
+	pc, _, err := bc.conn.ReceivePacketConn()
+	return pc, err
+}
+
+// request sends the request and receives the command of the reply. An error
+// reply is returned as a *BindError.
+func (bc *BinderClient) request(network, address string, reusePort bool) (Command, error) {
+	err := bc.conn.sendMessage(&bindRequest{
+		Network:   network,
+		Address:   address,
+		ReusePort: reusePort,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	cmd, err := bc.conn.ReceiveCommand()
+	if err != nil {
+		return 0, err
+	}
+	if cmd == DataCommand {
+		return 0, &BindError{Network: network, Address: address, Err: bc.conn.receiveError()}
+	}
+	return cmd, nil
+}
+
+// Close closes the connection to the binder.
+func (bc *BinderClient) Close() error {
+	return bc.conn.Close()
+}
+
+type bindRequest struct {
+	Network   string
+	Address   string
+	ReusePort bool
+}
+
+func (r *bindRequest) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.writeBytes([]byte(r.Network))
+	bw.writeBytes([]byte(r.Address))
+	bw.write(r.ReusePort)
+	return bw.err
+}
+
+func (r *bindRequest) deserialize(rd io.Reader) error {
+	br := &bytesReader{rd, nil}
+	r.Network = string(br.readBytes())
+	r.Address = string(br.readBytes())
+	br.read(&r.ReusePort)
+	return br.err
+}
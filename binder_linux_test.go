@@ -0,0 +1,100 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestBinder(t *testing.T) {
+	b := &Binder{
+		Rules: []BindRule{
+			{Network: "tcp", Hosts: []string{"::1", "127.0.0.1"}, MinPort: 0, MaxPort: 65535, ReusePort: true, UID: ID(os.Getuid())},
+			{Network: "udp", MinPort: 0, MaxPort: 0},
+			{Network: "tcp", Hosts: []string{"127.0.0.2"}, MinPort: 0, MaxPort: 65535, UID: ID(os.Getuid() + 1)},
+		},
+	}
+
+	conn, client := connPair(t, "a")
+	defer conn.Close()
+	done := make(chan error)
+	go func() { done <- b.ServeConn(conn) }()
+
+	bc := NewBinderClient(client)
+
+	t.Run("tcp listener with reuseport", func(t *testing.T) {
+		l1, err := bc.Listen("tcp", "127.0.0.1:0", true)
+		if err != nil {
+			t.Fatalf("Listen error: %v", err)
+		}
+		defer l1.Close()
+
+		l2, err := bc.Listen("tcp", l1.Addr().String(), true)
+		if err != nil {
+			t.Fatalf("Listen with reuseport error: %v", err)
+		}
+		defer l2.Close()
+
+		l2.Close()
+		go func() {
+			c, err := net.Dial("tcp", l1.Addr().String())
+			if err == nil {
+				c.Close()
+			}
+		}()
+		c, err := l1.Accept()
+		if err != nil {
+			t.Fatalf("Accept error: %v", err)
+		}
+		c.Close()
+	})
+
+	t.Run("udp packet conn", func(t *testing.T) {
+		pc, err := bc.ListenPacket("udp", "127.0.0.1:0", false)
+		if err != nil {
+			t.Fatalf("ListenPacket error: %v", err)
+		}
+		defer pc.Close()
+
+		if _, ok := pc.LocalAddr().(*net.UDPAddr); !ok {
+			t.Errorf("got local address %T but want *net.UDPAddr", pc.LocalAddr())
+		}
+	})
+
+	var tests = []struct {
+		name      string
+		network   string
+		address   string
+		reusePort bool
+		packet    bool
+	}{
+		{"port out of range", "udp", "127.0.0.1:53", false, true},
+		{"reuseport not permitted", "udp", "127.0.0.1:0", true, true},
+		{"host not permitted", "tcp", ":0", false, false},
+		{"uid not matched", "tcp", "127.0.0.2:0", false, false},
+		{"bad address", "unix", "/tmp/sock", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.packet {
+				_, err = bc.ListenPacket(tt.network, tt.address, tt.reusePort)
+			} else {
+				_, err = bc.Listen(tt.network, tt.address, tt.reusePort)
+			}
+			var berr *BindError
+			if !errors.As(err, &berr) {
+				t.Fatalf("got error `%v` but want *BindError", err)
+			}
+			if tt.network != "unix" && !errors.Is(err, ErrNotPermitted) {
+				t.Errorf("got error `%v` but want `%v`", err, ErrNotPermitted)
+			}
+		})
+	}
+
+	bc.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn error: %v", err)
+	}
+}
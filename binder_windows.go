@@ -0,0 +1,9 @@
+package ipc
+
+import (
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return ErrNotSupported
+}
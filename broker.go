@@ -0,0 +1,204 @@
+package ipc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BrokerRule permits peers to open files under PathPrefix.
+//
+// Flags is the set of open flags (os.O_RDONLY, os.O_RDWR, os.O_CREATE, ...)
+// the peer may use; a request with any other flag is denied. UID restricts the
+// rule to the peer with the uid; set it with ID, or leave it nil to match any
+// peer.
+type BrokerRule struct {
+	PathPrefix string
+	Flags      int
+	UID        *int
+}
+
+func (r *BrokerRule) permits(p *Peer, name string, flag int) bool {
+	if r.UID != nil && *r.UID != p.UID {
+		return false
+	}
+	if flag&^r.Flags != 0 {
+		return false
+	}
+	prefix := filepath.Clean(r.PathPrefix)
+	if name == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(name, prefix)
+}
+
+// Broker opens files on behalf of unprivileged peers; it is the privileged
+// side of the privilege separation.
+//
+// A peer sends an open request with BrokerClient. The broker checks it against
+// Rules and replies with the opened file via SendFile, or with a BrokerError.
+// A request is permitted if any rule permits it.
+//
+// The path is checked as is, and opened without following symbolic links
+// under the prefix, so that a peer can not escape from it by replacing a
+// component with a link; a link under the prefix is refused even if it points
+// inside. The permission bits of a created file are masked with 0777.
+//
+// It is not supported on windows.
+type Broker struct {
+	Rules []BrokerRule
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine.
+// It returns when Accept fails, e.g. l was closed.
+func (b *Broker) Serve(l *Listener) error {
+	return serveConns(l, b.ServeConn)
+}
+
+// ServeConn serves open requests on c until the peer closes the connection or
+// an error occurs. The connection is not closed by ServeConn.
+func (b *Broker) ServeConn(c *Conn) error {
+	for {
+		var req brokerRequest
+		if err := c.receiveRequest("broker", &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		f, err := b.open(c, &req)
+		if err != nil {
+			err = c.sendError(err)
+		} else {
+			err = c.SendFile(f, nil)
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Broker) open(c *Conn, req *brokerRequest) (*os.File, error) {
+	p, err := c.Peer()
+	if err != nil {
+		return nil, err
+	}
+
+	if !filepath.IsAbs(req.Path) {
+		return nil, ErrNotPermitted
+	}
+	name := filepath.Clean(req.Path)
+
+	for i := range b.Rules {
+		if b.Rules[i].permits(p, name, req.Flag) {
+			prefix := filepath.Clean(b.Rules[i].PathPrefix)
+			rel, err := filepath.Rel(prefix, name)
+			if err != nil {
+				return nil, ErrNotPermitted
+			}
+			if rel == "." {
+				// the prefix itself
+				prefix, rel = filepath.Dir(prefix), filepath.Base(prefix)
+			}
+			return openBeneath(prefix, rel, req.Flag, req.Perm.Perm())
+		}
+	}
+	return nil, ErrNotPermitted
+}
+
+// BrokerError is returned by BrokerClient.Open when the broker did not open
+// the file.
+//
+// Err is ErrNotPermitted if the broker rules denied the request. Otherwise it
+// is os.ErrNotExist, os.ErrExist, os.ErrPermission or an error with the
+// message of the broker, so errors.Is can be used to examine it.
+type BrokerError struct {
+	Path string
+	Err  error
+}
+
+func (e *BrokerError) Error() string {
+	return "broker: open " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *BrokerError) Unwrap() error {
+	return e.Err
+}
+
+// BrokerClient sends open requests to a Broker. It is safe for concurrent use.
+type BrokerClient struct {
+	conn *Conn
+	m    sync.Mutex // guard conn
+}
+
+// NewBrokerClient creates a BrokerClient using the connection to a Broker.
+func NewBrokerClient(c *Conn) *BrokerClient {
+	return &BrokerClient{conn: c}
+}
+
+// Open asks the broker to open the named file like os.OpenFile. name must be
+// an absolute path.
+//
+// If the broker refuses or fails, the error is a *BrokerError.
+func (bc *BrokerClient) Open(name string, flag int, perm os.FileMode) (*os.File, error) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+
+	err := bc.conn.sendMessage(&brokerRequest{Path: name, Flag: flag, Perm: perm})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := bc.conn.ReceiveCommand()
+	if err != nil {
+		return nil, err
+	}
+	switch cmd {
+	case FileCommand:
+		f, _, err := bc.conn.ReceiveFile()
+		return f, err
+	case DataCommand:
+		return nil, &BrokerError{Path: name, Err: bc.conn.receiveError()}
+	}
+	return nil, fmt.Errorf("broker: unexpected command %v", cmd)
+}
+
+// Close closes the connection to the broker.
+func (bc *BrokerClient) Close() error {
+	return bc.conn.Close()
+}
+
+type brokerRequest struct {
+	Path string
+	Flag int
+	Perm os.FileMode
+}
+
+func (r *brokerRequest) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.writeBytes([]byte(r.Path))
+	bw.write(int32(r.Flag))
+	bw.write(uint32(r.Perm))
+	return bw.err
+}
+
+func (r *brokerRequest) deserialize(rd io.Reader) error {
+	br := &bytesReader{rd, nil}
+	r.Path = string(br.readBytes())
+	var i32 int32
+	br.read(&i32)
+	r.Flag = int(i32)
+	var u32 uint32
+	br.read(&u32)
+	r.Perm = os.FileMode(u32)
+	return br.err
+}
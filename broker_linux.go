@@ -0,0 +1,49 @@
+package ipc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// openBeneath opens the path rel under the directory dir. No symbolic link
+// is followed in rel; a link is reported as ErrNotPermitted.
+func openBeneath(dir, rel string, flag int, perm os.FileMode) (*os.File, error) {
+	name := filepath.Join(dir, rel)
+	dirfd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+
+	components := strings.Split(rel, string(filepath.Separator))
+	for _, c := range components[:len(components)-1] {
+		fd, err := unix.Openat(dirfd, c, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(dirfd)
+		if err == unix.ENOTDIR {
+			// O_DIRECTORY fails before O_NOFOLLOW on a link
+			return nil, ErrNotPermitted
+		}
+		if err != nil {
+			return nil, openError(name, err)
+		}
+		dirfd = fd
+	}
+
+	last := components[len(components)-1]
+	fd, err := unix.Openat(dirfd, last, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm))
+	unix.Close(dirfd)
+	if err != nil {
+		return nil, openError(name, err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func openError(name string, err error) error {
+	// O_NOFOLLOW fails with ELOOP on a link
+	if err == unix.ELOOP {
+		return ErrNotPermitted
+	}
+	return &os.PathError{Op: "open", Path: name, Err: err}
+}
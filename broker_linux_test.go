@@ -0,0 +1,124 @@
+package ipc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipc-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	allowed := filepath.Join(dir, "allowed")
+	if err := os.Mkdir(allowed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(allowed, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(allowed, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(allowed, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Broker{
+		Rules: []BrokerRule{
+			{PathPrefix: allowed, Flags: os.O_RDONLY, UID: ID(os.Getuid())},
+			{PathPrefix: filepath.Join(allowed, "new"), Flags: os.O_WRONLY | os.O_CREATE},
+			{PathPrefix: filepath.Join(dir, "other"), Flags: os.O_RDONLY, UID: ID(os.Getuid() + 1)},
+		},
+	}
+
+	conn, client := connPair(t, "a")
+	defer conn.Close()
+	done := make(chan error)
+	go func() { done <- b.ServeConn(conn) }()
+
+	bc := NewBrokerClient(client)
+
+	t.Run("permitted file is opened", func(t *testing.T) {
+		f, err := bc.Open(filepath.Join(allowed, "file"), os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("Open error: %v", err)
+		}
+		defer f.Close()
+
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "content"; got != want {
+			t.Errorf("got %q but want %q", got, want)
+		}
+	})
+
+	t.Run("special permission bits are masked", func(t *testing.T) {
+		name := filepath.Join(allowed, "new")
+		f, err := bc.Open(name, os.O_WRONLY|os.O_CREATE, os.ModeSetuid|0755)
+		if err != nil {
+			t.Fatalf("Open error: %v", err)
+		}
+		f.Close()
+
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSetuid != 0 {
+			t.Errorf("got mode %v", fi.Mode())
+		}
+	})
+
+	var tests = []struct {
+		name string
+		path string
+		flag int
+		want error
+	}{
+		{"outside of prefix", filepath.Join(dir, "secret"), os.O_RDONLY, ErrNotPermitted},
+		{"uid not matched", filepath.Join(dir, "other"), os.O_RDONLY, ErrNotPermitted},
+		{"escape with dot dot", filepath.Join(allowed, "..", "secret"), os.O_RDONLY, ErrNotPermitted},
+		{"escape with symlink", filepath.Join(allowed, "link"), os.O_RDONLY, ErrNotPermitted},
+		{"escape with symlinked directory", filepath.Join(allowed, "linkdir", "secret"), os.O_RDONLY, ErrNotPermitted},
+		{"relative path", "allowed/file", os.O_RDONLY, ErrNotPermitted},
+		{"flag not permitted", filepath.Join(allowed, "file"), os.O_RDWR, ErrNotPermitted},
+		{"not exist", filepath.Join(allowed, "none"), os.O_RDONLY, os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := bc.Open(tt.path, tt.flag, 0)
+			if err == nil {
+				f.Close()
+				t.Fatal("expected error but returned nil")
+			}
+			var berr *BrokerError
+			if !errors.As(err, &berr) {
+				t.Fatalf("got error %T but want *BrokerError", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got error `%v` but want `%v`", err, tt.want)
+			}
+		})
+	}
+
+	bc.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeConn error: %v", err)
+	}
+	conn.Close()
+}
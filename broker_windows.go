@@ -0,0 +1,9 @@
+package ipc
+
+import (
+	"os"
+)
+
+func openBeneath(dir, rel string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,29 @@
+package ipc
+
+import "os/exec"
+
+// parentEnv is the environment variable telling a child started by
+// StartChild the descriptor of the IPC connection.
+const parentEnv = "GO_IPC_PARENT_FD"
+
+// StartChild starts cmd connected to the parent by an IPC connection, and
+// returns the connection. One end of a socketpair is passed to the child as
+// an entry of cmd.ExtraFiles, and its descriptor number is set to the
+// environment variable GO_IPC_PARENT_FD; the child gets the connection with
+// FromParent. If cmd.Env is nil, the environment of the process is used.
+//
+// Unlike Listen and Dial, no name is needed, and the connection is ready
+// before the child starts.
+//
+// It is not supported on windows.
+func StartChild(cmd *exec.Cmd) (*Conn, error) {
+	return startChild(cmd, parentEnv)
+}
+
+// FromParent returns the connection to the parent which started the process
+// with StartChild, or ErrNoParent. The environment variable is unset so that
+// it is not inherited by the children of the process; FromParent succeeds
+// only once.
+func FromParent() (*Conn, error) {
+	return fromParent(parentEnv)
+}
@@ -0,0 +1,74 @@
+package ipc
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// startChild starts cmd with one end of a socketpair, and returns the Conn of
+// the other end. The descriptor number of the child end is set to the
+// environment variable env.
+func startChild(cmd *exec.Cmd, env string) (*Conn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "ipc-parent")
+	child := os.NewFile(uintptr(fds[1]), "ipc-child")
+	defer child.Close()
+
+	conn, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// ExtraFiles[i] becomes the descriptor 3+i in the child
+	cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+	fd := 3 + len(cmd.ExtraFiles) - 1
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env+"="+strconv.Itoa(fd))
+
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn), nil
+}
+
+// fromParent returns the Conn to the parent started the process with
+// startChild, or ErrNoParent. env is unset so that it is not inherited by the
+// children of the process.
+func fromParent(env string) (*Conn, error) {
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return nil, ErrNoParent
+	}
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, ErrNoParent
+	}
+	f := os.NewFile(uintptr(fd), "ipc-parent")
+	if f == nil {
+		return nil, ErrNoParent
+	}
+	unix.CloseOnExec(fd)
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.(*net.UnixConn); !ok {
+		conn.Close()
+		return nil, ErrNoParent
+	}
+	return newConn(conn), nil
+}
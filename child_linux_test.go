@@ -0,0 +1,69 @@
+package ipc
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+const childEnv = "GO_IPC_TEST_CHILD"
+
+// TestChild is the child started by TestStartChild. It echoes the data from
+// the parent.
+func TestChild(t *testing.T) {
+	if os.Getenv(childEnv) == "" {
+		t.Skip("run by TestStartChild")
+	}
+
+	conn, err := FromParent()
+	if err != nil {
+		t.Fatalf("FromParent error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := FromParent(); err != ErrNoParent {
+		t.Errorf("got error `%v` of second FromParent but want `%v`", err, ErrNoParent)
+	}
+
+	if _, err := conn.ReceiveCommand(); err != nil {
+		t.Fatalf("ReceiveCommand error: %v", err)
+	}
+	data, err := conn.ReceiveData()
+	if err != nil {
+		t.Fatalf("ReceiveData error: %v", err)
+	}
+	if err := conn.SendData(data); err != nil {
+		t.Fatalf("SendData error: %v", err)
+	}
+}
+
+func TestStartChild(t *testing.T) {
+	if _, err := FromParent(); err != ErrNoParent {
+		t.Errorf("got error `%v` but want `%v`", err, ErrNoParent)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestChild$")
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	cmd.Stderr = os.Stderr
+	conn, err := StartChild(cmd)
+	if err != nil {
+		t.Fatalf("StartChild error: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SendData([]byte("ping")); err != nil {
+		t.Fatalf("SendData error: %v", err)
+	}
+	if cmd, err := conn.ReceiveCommand(); err != nil || cmd != DataCommand {
+		t.Fatalf("got command %v, error `%v`", cmd, err)
+	}
+	data, err := conn.ReceiveData()
+	if err != nil {
+		t.Fatalf("ReceiveData error: %v", err)
+	}
+	if string(data) != "ping" {
+		t.Errorf("got %q but want %q", data, "ping")
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("child error: %v", err)
+	}
+}
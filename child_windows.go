@@ -0,0 +1,11 @@
+package ipc
+
+import "os/exec"
+
+func startChild(cmd *exec.Cmd, env string) (*Conn, error) {
+	return nil, ErrNotSupported
+}
+
+func fromParent(env string) (*Conn, error) {
+	return nil, ErrNoParent
+}
@@ -0,0 +1,216 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+// ConnListenerOptions configures a ConnListener. The callbacks are called in
+// the goroutine receiving from the IPC connection; a blocking callback blocks
+// the receiving.
+type ConnListenerOptions struct {
+	// Backlog is the capacity of the queue of connections not accepted yet.
+	// See NewQueueListener.
+	Backlog uint
+
+	// HandBackQueued hands the connections not accepted yet back to the peer
+	// with Conn.HandBack on Close, instead of closing them.
+	HandBackQueued bool
+
+	// OnData is called with data the peer sent with SendData. If nil, the
+	// data is discarded.
+	OnData func(data []byte)
+
+	// OnFile is called with a file the peer sent with SendFile. If nil, the
+	// file is closed.
+	OnFile func(f *os.File, msg []byte)
+
+	// OnListener is called with a listener the peer sent with SendListener.
+	// If nil, the listener is closed.
+	OnListener func(l net.Listener, msg []byte)
+
+	// OnPacketConn is called with a socket the peer sent with SendPacketConn.
+	// If nil, the socket is closed.
+	OnPacketConn func(pc net.PacketConn, msg []byte)
+}
+
+// ReceivedConn is a connection accepted from ConnListener.
+type ReceivedConn struct {
+	TCPConn
+	msg []byte
+}
+
+// Msg returns the additional information the peer passed with the
+// connection, or nil if nothing.
+func (c *ReceivedConn) Msg() []byte {
+	return c.msg
+}
+
+// ConnListener is a net.Listener accepting TCP connections passed over an IPC
+// connection, e.g. from a Dispatcher. It can be given to http.Server.Serve
+// directly:
+//
+//	conn, _ := ipc.Dial("master")
+//	srv.Serve(ipc.NewConnListener(conn, nil))
+//
+// Accept returns *ReceivedConn. Connections passed with SendTCPConnWithAck are
+// accepted once they are queued.
+//
+// The listener is closed when the IPC connection is closed by the peer or
+// fails; Accept returns the error of the IPC connection then.
+type ConnListener struct {
+	ql   *QueueListener
+	conn *Conn
+	opts ConnListenerOptions
+
+	m      sync.Mutex // guard below
+	err    error
+	closed bool
+}
+
+// NewConnListener creates a ConnListener receiving from conn and starts the
+// receiving. The listener owns conn; it is closed with the listener. opts may
+// be nil.
+func NewConnListener(conn *Conn, opts *ConnListenerOptions) *ConnListener {
+	l := &ConnListener{conn: conn}
+	if opts != nil {
+		l.opts = *opts
+	}
+	l.ql = NewQueueListener(l.opts.Backlog)
+	if l.opts.HandBackQueued {
+		l.ql.OnClose = HandBackQueued(conn)
+	}
+
+	go l.receive()
+	return l
+}
+
+// Accept waits for and returns the next connection as *ReceivedConn.
+func (l *ConnListener) Accept() (net.Conn, error) {
+	conn, err := l.ql.Accept()
+	if err == ErrClosedQueue {
+		l.m.Lock()
+		if l.err != nil {
+			err = l.err
+		}
+		l.m.Unlock()
+	}
+	return conn, err
+}
+
+// Close closes the listener and the IPC connection. The connections not
+// accepted yet are closed, or handed back if HandBackQueued is set.
+func (l *ConnListener) Close() error {
+	l.m.Lock()
+	l.closed = true
+	l.m.Unlock()
+
+	err := l.ql.Close()
+	l.conn.Close()
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *ConnListener) Addr() net.Addr {
+	return l.ql.Addr()
+}
+
+func (l *ConnListener) receive() {
+	err := l.receiveLoop()
+
+	l.m.Lock()
+	if !l.closed {
+		l.err = err
+	}
+	l.m.Unlock()
+	l.Close()
+}
+
+func (l *ConnListener) receiveLoop() error {
+	for {
+		cmd, err := l.conn.ReceiveCommand()
+		if err != nil {
+			return err
+		}
+		if err := l.handleCommand(cmd); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *ConnListener) handleCommand(cmd Command) error {
+	c := l.conn
+	switch cmd {
+	case DataCommand:
+		data, err := c.ReceiveData()
+		if err != nil {
+			return err
+		}
+		if l.opts.OnData != nil {
+			l.opts.OnData(data)
+		}
+		return nil
+
+	case TCPConnCommand:
+		tcp, h, withData, err := c.ReceiveTCPConnWithAck()
+		if err != nil {
+			return err
+		}
+		msg, err := l.receiveMsg(withData)
+		if err != nil {
+			tcp.Close()
+			return err
+		}
+		setHandoffMsg(tcp, msg)
+		return l.ql.feed(&ReceivedConn{tcp, msg}, h)
+
+	case FileCommand:
+		f, withData, err := c.ReceiveFile()
+		if err != nil {
+			return err
+		}
+		msg, err := l.receiveMsg(withData)
+		if err != nil || l.opts.OnFile == nil {
+			f.Close()
+			return err
+		}
+		l.opts.OnFile(f, msg)
+		return nil
+
+	case ListenerCommand:
+		ln, withData, err := c.ReceiveListener()
+		if err != nil {
+			return err
+		}
+		msg, err := l.receiveMsg(withData)
+		if err != nil || l.opts.OnListener == nil {
+			ln.Close()
+			return err
+		}
+		l.opts.OnListener(ln, msg)
+		return nil
+
+	case PacketConnCommand:
+		pc, withData, err := c.ReceivePacketConn()
+		if err != nil {
+			return err
+		}
+		msg, err := l.receiveMsg(withData)
+		if err != nil || l.opts.OnPacketConn == nil {
+			pc.Close()
+			return err
+		}
+		l.opts.OnPacketConn(pc, msg)
+		return nil
+	}
+	return errors.New("unexpected command " + cmd.String())
+}
+
+func (l *ConnListener) receiveMsg(withData bool) ([]byte, error) {
+	if !withData {
+		return nil, nil
+	}
+	return l.conn.ReceiveData()
+}
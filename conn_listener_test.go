@@ -0,0 +1,60 @@
+package ipc
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConnListener(t *testing.T) {
+	master, worker := connPair(t, "a")
+	defer master.Close()
+
+	data := make(chan []byte, 1)
+	l := NewConnListener(worker, &ConnListenerOptions{
+		Backlog: 1,
+		OnData:  func(d []byte) { data <- d },
+	})
+	defer l.Close()
+
+	server, client := tcpPair(t)
+	defer client.Close()
+	if err := master.SendTCPConn(server, []byte("peeked"), []byte("msg")); err != nil {
+		t.Fatalf("SendTCPConn error: %v", err)
+	}
+	if err := master.SendData([]byte("data")); err != nil {
+		t.Fatalf("SendData error: %v", err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error: %v", err)
+	}
+	defer conn.Close()
+	rc, ok := conn.(*ReceivedConn)
+	if !ok {
+		t.Fatalf("accepted %T", conn)
+	}
+	if got, want := string(rc.Msg()), "msg"; got != want {
+		t.Errorf("got msg %q but want %q", got, want)
+	}
+	buf := make([]byte, 6)
+	if err := readAll(rc, buf); err != nil || string(buf) != "peeked" {
+		t.Errorf("got %q, %v but want %q", buf, err, "peeked")
+	}
+
+	select {
+	case d := <-data:
+		if string(d) != "data" {
+			t.Errorf("got data %q but want %q", d, "data")
+		}
+	case <-time.After(time.Second):
+		t.Error("OnData is not called")
+	}
+
+	// closing the IPC connection closes the listener
+	master.Close()
+	if _, err := l.Accept(); err != io.EOF {
+		t.Errorf("Accept returned `%v` but want `%v`", err, io.EOF)
+	}
+}
@@ -0,0 +1,527 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrDispatcherClosed is returned by Dispatcher.Serve after a call to
+	// Shutdown or Close.
+	ErrDispatcherClosed = errors.New("dispatcher closed")
+
+	// ErrNoWorker is returned when there is no worker to pass a connection.
+	ErrNoWorker = errors.New("no worker")
+)
+
+// Worker is a worker process registered to a Dispatcher.
+type Worker struct {
+	// accessed atomically; at the top for the alignment on 32bit platforms
+	reported int64 // outstanding connections reported by the worker
+	passed   int64 // connections passed since the last report
+	removed  int32 // set by RemoveWorker
+
+	conn *Conn
+	m    sync.Mutex // guard writes to conn
+
+	id     int
+	attrM  sync.Mutex // guard name, group and weight
+	name   string
+	group  string
+	weight int
+}
+
+// Conn returns the connection to the worker.
+func (w *Worker) Conn() *Conn {
+	return w.conn
+}
+
+// Name returns the name of the worker. It is a sequential number given by the
+// dispatcher unless SetName is called.
+func (w *Worker) Name() string {
+	w.attrM.Lock()
+	defer w.attrM.Unlock()
+
+	if w.name == "" {
+		return strconv.Itoa(w.id)
+	}
+	return w.name
+}
+
+// SetName sets the name of the worker. Give the same name to the replacement
+// of a worker to keep clients on it with ConsistentHash.
+func (w *Worker) SetName(name string) {
+	w.attrM.Lock()
+	defer w.attrM.Unlock()
+	w.name = name
+}
+
+// Group returns the group of the worker used by routers such as HTTPRouter.
+func (w *Worker) Group() string {
+	w.attrM.Lock()
+	defer w.attrM.Unlock()
+	return w.group
+}
+
+// SetGroup sets the group of the worker.
+func (w *Worker) SetGroup(group string) {
+	w.attrM.Lock()
+	defer w.attrM.Unlock()
+	w.group = group
+}
+
+// Weight returns the weight of the worker used by Weighted; default is 1.
+func (w *Worker) Weight() int {
+	w.attrM.Lock()
+	defer w.attrM.Unlock()
+	return w.weight
+}
+
+// SetWeight sets the weight of the worker.
+func (w *Worker) SetWeight(weight int) {
+	w.attrM.Lock()
+	defer w.attrM.Unlock()
+	w.weight = weight
+}
+
+// Load returns the number of outstanding connections of the worker; it is
+// the count the worker reported with ReportLoad plus the connections passed
+// after the report.
+func (w *Worker) Load() int {
+	return int(atomic.LoadInt64(&w.reported) + atomic.LoadInt64(&w.passed))
+}
+
+// isRemoved reports whether w is removed from its dispatcher; balancers
+// forget the state of removed workers.
+func (w *Worker) isRemoved() bool {
+	return atomic.LoadInt32(&w.removed) != 0
+}
+
+func (w *Worker) setReportedLoad(n int64) {
+	atomic.StoreInt64(&w.reported, n)
+	atomic.StoreInt64(&w.passed, 0)
+}
+
+func (w *Worker) sendTCPConn(conn net.Conn, peeked, msg []byte) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err := w.conn.sendConn(conn, peeked, msg); err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.passed, 1)
+	return nil
+}
+
+// sendTCPConnWithAck passes conn as SendTCPConnWithAck does. The lock is
+// released while waiting for the acknowledgement.
+func (w *Worker) sendTCPConnWithAck(timeout time.Duration, conn net.Conn, peeked, msg []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	w.m.Lock()
+	seq, ch, err := w.conn.sendHandoff(ctx, conn, peeked, msg)
+	w.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := w.conn.waitHandoff(ctx, conn, seq, ch); err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.passed, 1)
+	return nil
+}
+
+// Dispatcher accepts TCP connections and passes each of them to one of the
+// registered workers; it is the master of prefork servers.
+//
+// If passing to a worker fails, the worker is removed and the connection is
+// passed to another worker. If no worker is left, the connection is closed. A
+// worker denied by the Limits or Policy of its Conn is kept and skipped.
+//
+// With AckTimeout, a worker can also refuse a connection; it is then passed
+// to another worker while the refusing worker is kept.
+//
+// The worker side receives the connections with QueueListener.Feed. A worker
+// can hand connections back with Conn.HandBack, e.g. idle keep-alive
+// connections on its shutdown; they are passed to another worker.
+type Dispatcher struct {
+	// Balancer selects a worker for each connection. If nil, RoundRobin is
+	// used.
+	Balancer Balancer
+
+	// Peek is called with an accepted connection before it is passed. The
+	// returned data is passed to the worker as the peeked data, and given to
+	// Balancer. If Peek returns an error, the connection is closed.
+	//
+	// conn is a *net.TCPConn, or a TCPConn handed back by a worker; the data
+	// the worker handed back with it is read first.
+	Peek func(conn net.Conn) ([]byte, error)
+
+	// ProxyProtocol is the version of the PROXY protocol header, 1 or 2,
+	// prepended to the peeked data. The workers can read the client addresses
+	// with ProxyListener. If zero, no header is sent.
+	ProxyProtocol int
+
+	// AckTimeout enables the acknowledged passing; connections are passed
+	// with SendTCPConnWithAck, and one refused or not acknowledged within
+	// AckTimeout is passed to another worker. If zero, connections are passed
+	// with SendTCPConn.
+	AckTimeout time.Duration
+
+	l          net.Listener
+	roundRobin Balancer
+
+	m       sync.Mutex // guard below
+	workers []*Worker
+	lastID  int
+	closed  bool
+
+	wg sync.WaitGroup // dispatching connections
+}
+
+// NewDispatcher creates a Dispatcher accepting connections from l. l must
+// return *net.TCPConn such as the listener made by net.Listen("tcp", ...).
+func NewDispatcher(l net.Listener) *Dispatcher {
+	return &Dispatcher{l: l, roundRobin: RoundRobin()}
+}
+
+// AddWorker registers the connection to a worker process. The dispatcher owns
+// c after the call; c is closed when the worker disconnects, fails or the
+// dispatcher is closed.
+func (d *Dispatcher) AddWorker(c *Conn) *Worker {
+	w := &Worker{conn: c, weight: 1}
+
+	d.m.Lock()
+	d.lastID++
+	w.id = d.lastID
+	if d.closed {
+		d.m.Unlock()
+		c.Close()
+		return w
+	}
+	d.workers = append(d.workers, w)
+	d.m.Unlock()
+
+	go d.readWorker(w)
+	return w
+}
+
+// RemoveWorker stops passing connections to w. The connection to w is kept
+// open until the worker disconnects, so that the worker can finish its work.
+func (d *Dispatcher) RemoveWorker(w *Worker) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for i, v := range d.workers {
+		if v == w {
+			d.workers = append(d.workers[:i], d.workers[i+1:]...)
+			atomic.StoreInt32(&w.removed, 1)
+			return
+		}
+	}
+}
+
+// Workers returns the workers connections are passed to.
+func (d *Dispatcher) Workers() []*Worker {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	ws := make([]*Worker, len(d.workers))
+	copy(ws, d.workers)
+	return ws
+}
+
+// dropWorker removes w and closes the connection to it.
+func (d *Dispatcher) dropWorker(w *Worker) {
+	d.RemoveWorker(w)
+	w.conn.Close()
+}
+
+// readWorker reads from the worker until it disconnects.
+func (d *Dispatcher) readWorker(w *Worker) {
+	defer d.dropWorker(w)
+
+	for {
+		cmd, err := w.conn.ReceiveCommand()
+		if err != nil {
+			return
+		}
+		if err := d.handleWorkerCommand(w, cmd); err != nil {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) handleWorkerCommand(w *Worker, cmd Command) error {
+	switch cmd {
+	case DataCommand:
+		var m workerMessage
+		if err := w.conn.receiveMessage(&m); err != nil {
+			return err
+		}
+		if m.Kind == workerLoad {
+			w.setReportedLoad(m.Value)
+		}
+		return nil
+	case TCPConnCommand:
+		conn, withData, err := w.conn.ReceiveTCPConn()
+		if err != nil {
+			return err
+		}
+		var msg []byte
+		if withData {
+			if msg, err = w.conn.ReceiveData(); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+
+		if !d.track() {
+			// shutting down; Shutdown no longer waits for new passing
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer d.wg.Done()
+			if err := d.redispatch(w, conn, msg); err != nil {
+				conn.Close()
+			}
+		}()
+		return nil
+	}
+	return errors.New("dispatcher: unexpected command " + cmd.String())
+}
+
+// redispatch passes a connection handed back by w to another worker.
+func (d *Dispatcher) redispatch(w *Worker, conn TCPConn, msg []byte) error {
+	var peeked []byte
+	if d.Peek != nil {
+		var err error
+		if peeked, err = d.Peek(conn); err != nil {
+			return err
+		}
+	} else {
+		// pass the handed back data as is
+		_, peeked, _ = unwrapConn(conn, nil)
+	}
+	return d.dispatch(conn, peeked, msg, []*Worker{w})
+}
+
+// Serve accepts connections and passes them to the workers. It returns when
+// Accept fails; after Shutdown or Close, it returns ErrDispatcherClosed.
+func (d *Dispatcher) Serve() error {
+	var tempDelay time.Duration
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			if d.isClosed() {
+				return ErrDispatcherClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		tcp, ok := conn.(*net.TCPConn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+
+		if !d.track() {
+			tcp.Close()
+			return ErrDispatcherClosed
+		}
+		go func() {
+			defer d.wg.Done()
+			if err := d.serveConn(tcp); err != nil {
+				tcp.Close()
+			}
+		}()
+	}
+}
+
+func (d *Dispatcher) serveConn(conn *net.TCPConn) error {
+	var peeked []byte
+	if d.Peek != nil {
+		var err error
+		if peeked, err = d.Peek(conn); err != nil {
+			return err
+		}
+	}
+	return d.Dispatch(conn, peeked, nil)
+}
+
+// Dispatch passes conn to one of the workers as SendTCPConn does. It tries
+// other workers while passing fails; a worker failed is removed, and a worker
+// refused, timed out, or denied by its Limits or Policy is skipped.
+//
+// conn is closed when the passing is succeeded but not if an error occurs.
+func (d *Dispatcher) Dispatch(conn *net.TCPConn, peeked, msg []byte) error {
+	return d.dispatch(conn, peeked, msg, nil)
+}
+
+// dispatch passes conn to one of the workers except ones in tried.
+func (d *Dispatcher) dispatch(conn net.Conn, peeked, msg []byte, tried []*Worker) error {
+	data := peeked
+	if d.ProxyProtocol != 0 {
+		src, _ := conn.RemoteAddr().(*net.TCPAddr)
+		dst, _ := conn.LocalAddr().(*net.TCPAddr)
+		if src == nil || dst == nil {
+			return ErrBadProxyHeader
+		}
+		hdr, err := AppendProxyHeader(nil, d.ProxyProtocol, src, dst)
+		if err != nil {
+			return err
+		}
+		data = append(hdr, peeked...)
+	}
+
+	for {
+		w := d.pick(conn, peeked, tried)
+		if w == nil {
+			return ErrNoWorker
+		}
+		tried = append(tried, w)
+
+		var err error
+		if d.AckTimeout == 0 {
+			err = w.sendTCPConn(conn, data, msg)
+		} else {
+			err = w.sendTCPConnWithAck(d.AckTimeout, conn, data, msg)
+		}
+		if err == nil {
+			return nil
+		}
+		if !skipWorker(err) {
+			// the stream to the worker may be broken
+			d.dropWorker(w)
+		}
+	}
+}
+
+// skipWorker reports whether err leaves the stream to the worker intact, so
+// that the worker is skipped instead of being removed. These errors occur
+// before anything is written, or are replies of the worker.
+func skipWorker(err error) bool {
+	if _, ok := err.(*LimitError); ok {
+		return true
+	}
+	switch err {
+	case ErrNotPermitted, ErrNotSupported, ErrRefused, context.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// pick selects a worker with the Balancer except ones in tried.
+func (d *Dispatcher) pick(conn net.Conn, peeked []byte, tried []*Worker) *Worker {
+	var candidates []*Worker
+	for _, w := range d.Workers() {
+		if !containsWorker(tried, w) {
+			candidates = append(candidates, w)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	b := d.Balancer
+	if b == nil {
+		b = d.roundRobin
+	}
+	client, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if client == nil {
+		client = &net.TCPAddr{}
+	}
+	return b.Pick(candidates, client, peeked)
+}
+
+func containsWorker(ws []*Worker, w *Worker) bool {
+	for _, v := range ws {
+		if v == w {
+			return true
+		}
+	}
+	return false
+}
+
+// track adds a passing to d.wg unless d is closed; d.wg.Add must not race
+// with d.wg.Wait in Shutdown.
+func (d *Dispatcher) track() bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.closed {
+		return false
+	}
+	d.wg.Add(1)
+	return true
+}
+
+func (d *Dispatcher) isClosed() bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.closed
+}
+
+// Shutdown stops the dispatcher gracefully. It closes the listener, waits for
+// connections being passed, then closes the connections to the workers.
+//
+// If ctx expires before the passing completes, Shutdown returns the error of
+// ctx and the workers are left open.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	err := d.closeListener()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	d.closeWorkers()
+	return err
+}
+
+// Close closes the listener and the connections to the workers immediately.
+func (d *Dispatcher) Close() error {
+	err := d.closeListener()
+	d.closeWorkers()
+	return err
+}
+
+func (d *Dispatcher) closeListener() error {
+	d.m.Lock()
+	if d.closed {
+		d.m.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.m.Unlock()
+
+	return d.l.Close()
+}
+
+func (d *Dispatcher) closeWorkers() {
+	for _, w := range d.Workers() {
+		d.dropWorker(w)
+	}
+}
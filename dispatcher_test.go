@@ -0,0 +1,204 @@
+package ipc
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// dispatcherWorker is a worker process of tests; it echoes its id to the
+// connections passed by the dispatcher.
+type dispatcherWorker struct {
+	conn *Conn
+	ql   *QueueListener
+}
+
+func startDispatcherWorker(t *testing.T, d *Dispatcher, pipename string, id byte) *dispatcherWorker {
+	master, conn := connPair(t, pipename)
+	d.AddWorker(master)
+
+	w := &dispatcherWorker{conn: conn, ql: NewQueueListener(10)}
+	go w.ql.Feed(conn)
+	go func() {
+		for {
+			c, err := w.ql.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte{id})
+			c.Close()
+		}
+	}()
+	return w
+}
+
+func (w *dispatcherWorker) stop() {
+	w.conn.Close()
+	w.ql.Close()
+}
+
+// dialWorker connects to the dispatcher and returns the id of the worker
+// which served the connection.
+func dialWorker(t *testing.T, addr string) byte {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	if len(b) != 1 {
+		return 0
+	}
+	return b[0]
+}
+
+func TestDispatcher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(l)
+	served := make(chan error)
+	go func() { served <- d.Serve() }()
+
+	w1 := startDispatcherWorker(t, d, "a", 1)
+	w2 := startDispatcherWorker(t, d, "b", 2)
+	defer w2.stop()
+
+	t.Run("round robin", func(t *testing.T) {
+		seen := map[byte]int{}
+		for i := 0; i < 4; i++ {
+			seen[dialWorker(t, l.Addr().String())]++
+		}
+		if seen[1] != 2 || seen[2] != 2 {
+			t.Errorf("connections are not distributed: %v", seen)
+		}
+	})
+
+	t.Run("disconnected worker is removed", func(t *testing.T) {
+		w1.stop()
+		for i := 0; i < 100 && len(d.Workers()) != 1; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got, want := len(d.Workers()), 1; got != want {
+			t.Fatalf("got %v workers but want %v", got, want)
+		}
+		for i := 0; i < 2; i++ {
+			if got, want := dialWorker(t, l.Addr().String()), byte(2); got != want {
+				t.Errorf("served by worker %v but want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("worker reports load", func(t *testing.T) {
+		if err := ReportLoad(w2.conn, 7); err != nil {
+			t.Fatalf("ReportLoad error: %v", err)
+		}
+		w := d.Workers()[0]
+		for i := 0; i < 100 && w.Load() != 7; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got, want := w.Load(), 7; got != want {
+			t.Errorf("got load %v but want %v", got, want)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		if err := d.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown error: %v", err)
+		}
+		if got, want := <-served, ErrDispatcherClosed; got != want {
+			t.Errorf("Serve returned `%v` but want `%v`", got, want)
+		}
+		if got := len(d.Workers()); got != 0 {
+			t.Errorf("got %v workers after shutdown", got)
+		}
+	})
+}
+
+func TestDispatcherLimitedWorker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(l)
+	defer d.Close()
+
+	w1 := startDispatcherWorker(t, d, "a", 1)
+	defer w1.stop()
+	w2 := startDispatcherWorker(t, d, "b", 2)
+	defer w2.stop()
+	d.Workers()[0].conn.SetLimits(Limits{MaxMessagesPerSecond: 1})
+	go d.Serve()
+
+	seen := map[byte]int{}
+	for i := 0; i < 3; i++ {
+		seen[dialWorker(t, l.Addr().String())]++
+	}
+	if seen[1] != 1 || seen[2] != 2 {
+		t.Errorf("got %v but want a connection to the limited worker", seen)
+	}
+	if got, want := len(d.Workers()), 2; got != want {
+		t.Errorf("got %v workers but want %v", got, want)
+	}
+}
+
+// startRefusingWorker starts a worker refusing every connection, or answering
+// too late if silent is true.
+func startRefusingWorker(t *testing.T, d *Dispatcher, pipename string, silent bool) *Conn {
+	master, conn := connPair(t, pipename)
+	d.AddWorker(master)
+
+	go func() {
+		for {
+			if _, err := conn.ReceiveCommand(); err != nil {
+				return
+			}
+			_, h, _, err := conn.ReceiveTCPConnWithAck()
+			if err != nil {
+				return
+			}
+			if silent {
+				time.Sleep(time.Until(h.Deadline()) + 10*time.Millisecond)
+				h.Accept()
+				continue
+			}
+			h.Refuse()
+		}
+	}()
+	return conn
+}
+
+func TestDispatcherAck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(l)
+	d.AckTimeout = 100 * time.Millisecond
+	defer d.Close()
+	go d.Serve()
+
+	refusing := startRefusingWorker(t, d, "a", false)
+	defer refusing.Close()
+	silent := startRefusingWorker(t, d, "b", true)
+	defer silent.Close()
+	w := startDispatcherWorker(t, d, "c", 3)
+	defer w.stop()
+
+	for i := 0; i < 3; i++ {
+		if got, want := dialWorker(t, l.Addr().String()), byte(3); got != want {
+			t.Errorf("served by worker %v but want %v", got, want)
+		}
+	}
+	if got, want := len(d.Workers()), 3; got != want {
+		t.Errorf("got %v workers but want %v; refusing worker must be kept", got, want)
+	}
+}
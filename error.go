@@ -9,7 +9,54 @@ var (
 	// that have been closed.
 	ErrClosedQueue = errors.New("closed queue")
 
+	// ErrQueueFull is returned from QueueListener.TryPush when the queue has
+	// no space.
+	ErrQueueFull = errors.New("queue full")
+
 	// ErrTimeout is returned when read or write operation is not completed
 	// before the deadline.
 	ErrTimeout = errors.New("timeout")
+
+	// ErrNotPermitted is returned when the access-control policy denies the
+	// command to the peer.
+	ErrNotPermitted = errors.New("not permitted")
+
+	// ErrNotSupported is returned when the operation is not supported on the
+	// platform.
+	ErrNotSupported = errors.New("not supported")
+
+	// ErrRefused is returned by SendTCPConnWithAck when the peer refused the
+	// connection.
+	ErrRefused = errors.New("refused")
+
+	// ErrHandoffExpired is returned by Handoff.Accept when the sender has
+	// stopped waiting for the acknowledgement.
+	ErrHandoffExpired = errors.New("handoff expired")
+
+	// ErrUpgradeInProgress is returned by Upgrader.Upgrade while another
+	// upgrade is running.
+	ErrUpgradeInProgress = errors.New("upgrade in progress")
+
+	// ErrNotReady is returned by Upgrader.Upgrade before the process itself
+	// called Ready.
+	ErrNotReady = errors.New("process not ready")
+
+	// ErrMigrationAborted is returned when the other side of a migration
+	// session aborted it.
+	ErrMigrationAborted = errors.New("migration aborted")
+
+	// ErrNoParent is returned when the process was not started by the parent
+	// the connection is looked up for, e.g. by FromParent.
+	ErrNoParent = errors.New("not started by a parent")
+
+	// ErrCrashLoop is returned by Supervisor.Wait when workers exited too
+	// often and the supervisor gave up restarting them.
+	ErrCrashLoop = errors.New("crash loop")
+
+	// ErrFDStoreFull is returned by FDStoreClient.Deposit when the user has
+	// deposited as many descriptors as the store permits.
+	ErrFDStoreFull = errors.New("fd store is full")
+
+	errMigrationDone     = errors.New("migration session already ended")
+	errSupervisorStopped = errors.New("supervisor stopped")
 )
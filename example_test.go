@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 
 	"github.com/navel3/go-ipc"
 )
@@ -107,6 +108,28 @@ func Example_server() {
 	}
 }
 
+func ExampleConnListener() {
+	conn, err := ipc.Dial("pipename")
+	if err != nil {
+		return
+	}
+
+	l := ipc.NewConnListener(conn, &ipc.ConnListenerOptions{
+		Backlog: 16,
+		OnData: func(d []byte) {
+			fmt.Println(string(d))
+		},
+	})
+	defer l.Close()
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "hello")
+		}),
+	}
+	srv.Serve(l) // returns when the peer closes conn
+}
+
 func Example_client() {
 	conn, err := ipc.Dial("pipename")
 	if err != nil {
@@ -0,0 +1,144 @@
+package ipc
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// ExecConn runs cmd in the style of inetd: the socket of conn is given to cmd
+// as the standard input and output, and the environment variables describe
+// the client. It waits for cmd to exit, and then closes conn. Call it in a
+// goroutine for each connection, e.g. received with ConnListener.
+//
+// The socket is handed over to cmd in blocking mode, as programs written for
+// inetd expect; conn must not be used by the caller after ExecConn is called.
+//
+// conn and buffered are same as Conn.HandBack; the peeked data of a received
+// TCPConn is delivered first. If there is such data, the standard input and
+// output are pipes relayed to and from the socket instead of the socket
+// itself.
+//
+// The variables are those of tcpserver, PROTO=TCP, TCPREMOTEIP,
+// TCPREMOTEPORT, TCPLOCALIP and TCPLOCALPORT, and REMOTE_ADDR and REMOTE_PORT
+// of CGI. The addresses are of conn, so a ProxyConn gives the client
+// addresses in the PROXY header. If cmd.Env is nil, the environment of the
+// process is used. cmd.Stderr is left as is.
+//
+// It is not supported on windows.
+func ExecConn(cmd *exec.Cmd, conn net.Conn, buffered []byte) error {
+	defer conn.Close()
+
+	sock, buffered, err := unwrapConn(conn, buffered)
+	if err != nil {
+		return err
+	}
+	sc, ok := sock.(syscall.Conn)
+	if !ok {
+		return ErrNotSupported
+	}
+	if tc, ok := sock.(*tcpConn); ok {
+		// conn is consumed; the peeked data is in buffered
+		tc.peeked = nil
+	}
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, connEnv(conn)...)
+
+	if len(buffered) == 0 {
+		return execSocket(cmd, conn, sc)
+	}
+	return execRelayed(cmd, sock, buffered)
+}
+
+// execSocket runs cmd with the socket as the standard input and output.
+func execSocket(cmd *exec.Cmd, conn net.Conn, sc syscall.Conn) error {
+	f, err := dupBlockingFile(sc, "socket")
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = f
+	cmd.Stdout = f
+	err = cmd.Start()
+	f.Close()
+	// the socket is owned by cmd; the copy of conn is blocking now
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// execRelayed runs cmd with pipes; buffered and then the data read from sock
+// are written to the standard input, and the standard output is copied to
+// sock.
+func execRelayed(cmd *exec.Cmd, sock net.Conn, buffered []byte) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = pr
+	// copied by cmd; Wait waits for the end of the output
+	cmd.Stdout = sock
+
+	err = cmd.Start()
+	pr.Close()
+	if err != nil {
+		pw.Close()
+		return err
+	}
+
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		defer pw.Close()
+		if _, err := pw.Write(buffered); err != nil {
+			return
+		}
+		io.Copy(pw, sock)
+	}()
+
+	err = cmd.Wait()
+	// stop the relay blocked on the socket
+	sock.SetReadDeadline(aLongTimeAgo)
+	pw.Close()
+	<-relayed
+	return err
+}
+
+// connEnv returns the environment variables describing the addresses of
+// conn.
+func connEnv(conn net.Conn) []string {
+	env := []string{"PROTO=TCP"}
+	if ip, port, ok := splitAddr(conn.RemoteAddr()); ok {
+		env = append(env,
+			"TCPREMOTEIP="+ip,
+			"TCPREMOTEPORT="+port,
+			"REMOTE_ADDR="+ip,
+			"REMOTE_PORT="+port,
+		)
+	}
+	if ip, port, ok := splitAddr(conn.LocalAddr()); ok {
+		env = append(env,
+			"TCPLOCALIP="+ip,
+			"TCPLOCALPORT="+port,
+		)
+	}
+	return env
+}
+
+func splitAddr(addr net.Addr) (string, string, bool) {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP.String(), strconv.Itoa(a.Port), true
+	}
+	if addr == nil {
+		return "", "", false
+	}
+	ip, port, err := net.SplitHostPort(addr.String())
+	return ip, port, err == nil
+}
@@ -0,0 +1,23 @@
+package ipc
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dupBlockingFile duplicates the descriptor of sc and clears O_NONBLOCK for a
+// child process. The flag is shared with sc, so sc must not be used after
+// that.
+func dupBlockingFile(sc syscall.Conn, name string) (*os.File, error) {
+	fd, err := dupFd(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.SetNonblock(fd, false); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("fcntl", err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
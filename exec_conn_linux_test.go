@@ -0,0 +1,92 @@
+package ipc
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestExecConn(t *testing.T) {
+	script := `printf '%s %s:%s\n' "$PROTO" "$TCPREMOTEIP" "$REMOTE_PORT"; head -c 11`
+
+	t.Run("socket as stdin", func(t *testing.T) {
+		conn, client := tcpPair(t)
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		done := make(chan error)
+		go func() { done <- ExecConn(exec.Command("sh", "-c", script), conn, nil) }()
+		client.Write([]byte("hello world"))
+
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		want := "TCP " + client.LocalAddr().String() + "\nhello world"
+		if string(out) != want {
+			t.Errorf("got %q but want %q", out, want)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("ExecConn error: %v", err)
+		}
+	})
+
+	t.Run("peeked data relayed", func(t *testing.T) {
+		sender, receiver := connPair(t, "a")
+		defer sender.Close()
+		defer receiver.Close()
+
+		conn, client := tcpPair(t)
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := sender.SendTCPConn(conn, []byte("hello "), nil); err != nil {
+			t.Fatalf("SendTCPConn error: %v", err)
+		}
+		if _, err := receiver.ReceiveCommand(); err != nil {
+			t.Fatalf("ReceiveCommand error: %v", err)
+		}
+		received, _, err := receiver.ReceiveTCPConn()
+		if err != nil {
+			t.Fatalf("ReceiveTCPConn error: %v", err)
+		}
+
+		done := make(chan error)
+		go func() { done <- ExecConn(exec.Command("sh", "-c", script), received, nil) }()
+		client.Write([]byte("world"))
+
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		want := "TCP " + client.LocalAddr().String() + "\nhello world"
+		if string(out) != want {
+			t.Errorf("got %q but want %q", out, want)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("ExecConn error: %v", err)
+		}
+	})
+	t.Run("client writes late", func(t *testing.T) {
+		conn, client := tcpPair(t)
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// the standard input is blocking; head fails on EAGAIN otherwise
+		done := make(chan error)
+		go func() { done <- ExecConn(exec.Command("sh", "-c", "head -c 5"), conn, nil) }()
+		time.Sleep(200 * time.Millisecond)
+		client.Write([]byte("hello"))
+
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if string(out) != "hello" {
+			t.Errorf("got %q but want %q", out, "hello")
+		}
+		if err := <-done; err != nil {
+			t.Errorf("ExecConn error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,10 @@
+package ipc
+
+import (
+	"os"
+	"syscall"
+)
+
+func dupBlockingFile(sc syscall.Conn, name string) (*os.File, error) {
+	return nil, ErrNotSupported
+}
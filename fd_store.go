@@ -0,0 +1,465 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FDStore keeps descriptors deposited by peers, so that they survive restarts
+// and crashes of the peers; a replacement of a crashed worker fetches its
+// listeners and connections from the store instead of binding them again. It
+// is a standalone alternative to the file descriptor store of systemd; see
+// NotifyFDStore.
+//
+// A peer deposits, fetches, lists and releases named descriptors with
+// FDStoreClient. The names are scoped by the uid of the peer; a peer can not
+// see the descriptors deposited by another user.
+//
+// It is not supported on windows.
+type FDStore struct {
+	// MaxEntries is the maximum number of descriptors deposited by each
+	// user, so that a peer can not exhaust the descriptors of the store. If
+	// zero, DefaultFDStoreMaxEntries is used.
+	MaxEntries int
+
+	m       sync.Mutex // guard below
+	entries map[fdStoreKey]*fdStoreEntry
+	counts  map[int]int // entries per uid
+}
+
+// DefaultFDStoreMaxEntries is the default of FDStore.MaxEntries.
+const DefaultFDStoreMaxEntries = 64
+
+type fdStoreKey struct {
+	uid  int
+	name string
+}
+
+type fdStoreEntry struct {
+	f    *os.File
+	meta []byte
+}
+
+// NewFDStore creates an FDStore.
+func NewFDStore() *FDStore {
+	return &FDStore{
+		entries: make(map[fdStoreKey]*fdStoreEntry),
+		counts:  make(map[int]int),
+	}
+}
+
+// Serve accepts connections on l and serves each of them in a new goroutine.
+// It returns when Accept fails, e.g. l was closed.
+func (s *FDStore) Serve(l *Listener) error {
+	return serveConns(l, s.ServeConn)
+}
+
+// ServeConn serves requests on c until the peer closes the connection or an
+// error occurs. The connection is not closed by ServeConn; the descriptors
+// deposited are kept after that.
+func (s *FDStore) ServeConn(c *Conn) error {
+	p, err := c.Peer()
+	if err != nil {
+		return err
+	}
+
+	for {
+		var req fdStoreRequest
+		if err := c.receiveRequest("fdstore", &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := s.serve(c, p.UID, &req); err != nil {
+			return err
+		}
+	}
+}
+
+// serve serves a request. It returns an error only if the connection is
+// broken.
+func (s *FDStore) serve(c *Conn, uid int, req *fdStoreRequest) error {
+	key := fdStoreKey{uid, req.Name}
+
+	switch req.Op {
+	case fdStoreDeposit:
+		f, err := receiveDeposit(c)
+		if err != nil {
+			return err
+		}
+		if err := s.deposit(key, f, req.Meta); err != nil {
+			f.Close()
+			return replyFDStoreError(c, err)
+		}
+		return c.sendMessage(&fdStoreReply{OK: true})
+
+	case fdStoreFetch:
+		s.m.Lock()
+		e, ok := s.entries[key]
+		var dup *os.File
+		var err error
+		if ok {
+			// the store keeps its copy
+			dup, err = dupFile(e.f, e.f.Name())
+		}
+		s.m.Unlock()
+		if !ok {
+			return replyFDStoreError(c, os.ErrNotExist)
+		}
+		if err != nil {
+			return replyFDStoreError(c, err)
+		}
+		if err := c.sendMessage(&fdStoreReply{OK: true}); err != nil {
+			dup.Close()
+			return err
+		}
+		err = c.SendFile(dup, e.meta)
+		dup.Close()
+		return err
+
+	case fdStoreList:
+		var list fdStoreListMessage
+		s.m.Lock()
+		for k, e := range s.entries {
+			if k.uid == uid {
+				list.Entries = append(list.Entries, FDStoreEntry{Name: k.name, Meta: e.meta})
+			}
+		}
+		s.m.Unlock()
+		if err := c.sendMessage(&fdStoreReply{OK: true}); err != nil {
+			return err
+		}
+		return c.sendMessage(&list)
+
+	case fdStoreRelease:
+		s.m.Lock()
+		e, ok := s.entries[key]
+		if ok {
+			delete(s.entries, key)
+			if s.counts[uid]--; s.counts[uid] == 0 {
+				delete(s.counts, uid)
+			}
+		}
+		s.m.Unlock()
+		if !ok {
+			return replyFDStoreError(c, os.ErrNotExist)
+		}
+		e.f.Close()
+		return c.sendMessage(&fdStoreReply{OK: true})
+	}
+	return replyFDStoreError(c, fmt.Errorf("unknown operation %d", req.Op))
+}
+
+func (s *FDStore) deposit(key fdStoreKey, f *os.File, meta []byte) error {
+	if key.name == "" {
+		return errors.New("empty name")
+	}
+
+	max := s.MaxEntries
+	if max == 0 {
+		max = DefaultFDStoreMaxEntries
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.entries[key]; ok {
+		return os.ErrExist
+	}
+	if s.counts[key.uid] >= max {
+		return ErrFDStoreFull
+	}
+	s.entries[key] = &fdStoreEntry{f: f, meta: meta}
+	s.counts[key.uid]++
+	return nil
+}
+
+// receiveDeposit receives the file following a deposit request.
+func receiveDeposit(c *Conn) (*os.File, error) {
+	cmd, err := c.ReceiveCommand()
+	if err != nil {
+		return nil, err
+	}
+	if cmd != FileCommand {
+		return nil, fmt.Errorf("fdstore: unexpected command %v", cmd)
+	}
+	f, withData, err := c.ReceiveFile()
+	if err != nil {
+		return nil, err
+	}
+	if withData {
+		if _, err := c.ReceiveData(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func replyFDStoreError(c *Conn, err error) error {
+	if err := c.sendMessage(&fdStoreReply{OK: false}); err != nil {
+		return err
+	}
+	return c.sendError(err)
+}
+
+// Close closes the descriptors stored.
+func (s *FDStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for k, e := range s.entries {
+		e.f.Close()
+		delete(s.entries, k)
+	}
+	for uid := range s.counts {
+		delete(s.counts, uid)
+	}
+	return nil
+}
+
+// FDStoreEntry is an entry listed by FDStoreClient.List.
+type FDStoreEntry struct {
+	Name string
+	Meta []byte
+}
+
+// FDStoreClient sends requests to an FDStore. It is safe for concurrent use.
+//
+// The errors of the store are returned as is; a missing name is reported with
+// os.ErrNotExist, a name already used with os.ErrExist, and a deposit over
+// FDStore.MaxEntries with ErrFDStoreFull.
+type FDStoreClient struct {
+	conn *Conn
+	m    sync.Mutex // guard conn
+}
+
+// NewFDStoreClient creates an FDStoreClient using the connection to an
+// FDStore.
+func NewFDStoreClient(c *Conn) *FDStoreClient {
+	return &FDStoreClient{conn: c}
+}
+
+// Deposit stores a duplicate of fd under name with the metadata. fd is e.g. a
+// listener, a TCPConn or an *os.File such as a memfd; it is left open.
+func (sc *FDStoreClient) Deposit(name string, fd syscall.Conn, meta []byte) error {
+	f, err := dupFile(fd, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	err = sc.conn.sendMessage(&fdStoreRequest{Op: fdStoreDeposit, Name: name, Meta: meta})
+	if err != nil {
+		return err
+	}
+	if err := sc.conn.SendFile(f, nil); err != nil {
+		return err
+	}
+	return sc.receiveReply()
+}
+
+// Fetch returns a duplicate of the descriptor stored under name and its
+// metadata. The descriptor is kept in the store.
+func (sc *FDStoreClient) Fetch(name string) (*os.File, []byte, error) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	if err := sc.request(fdStoreFetch, name); err != nil {
+		return nil, nil, err
+	}
+	cmd, err := sc.conn.ReceiveCommand()
+	if err != nil {
+		return nil, nil, err
+	}
+	if cmd != FileCommand {
+		return nil, nil, fmt.Errorf("fdstore: unexpected command %v", cmd)
+	}
+	f, withData, err := sc.conn.ReceiveFile()
+	if err != nil || !withData {
+		return f, nil, err
+	}
+	meta, err := sc.conn.ReceiveData()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, meta, nil
+}
+
+// FetchListener is like Fetch but returns the descriptor as a listener.
+func (sc *FDStoreClient) FetchListener(name string) (net.Listener, []byte, error) {
+	f, meta, err := sc.Fetch(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	return l, meta, err
+}
+
+// FetchConn is like Fetch but returns the descriptor as a connection.
+func (sc *FDStoreClient) FetchConn(name string) (net.Conn, []byte, error) {
+	f, meta, err := sc.Fetch(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	return conn, meta, err
+}
+
+// List returns the entries stored.
+func (sc *FDStoreClient) List() ([]FDStoreEntry, error) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+
+	if err := sc.request(fdStoreList, ""); err != nil {
+		return nil, err
+	}
+	cmd, err := sc.conn.ReceiveCommand()
+	if err != nil {
+		return nil, err
+	}
+	if cmd != DataCommand {
+		return nil, fmt.Errorf("fdstore: unexpected command %v", cmd)
+	}
+	var list fdStoreListMessage
+	if err := sc.conn.receiveMessage(&list); err != nil {
+		return nil, err
+	}
+	return list.Entries, nil
+}
+
+// Release removes the descriptor stored under name, and closes it in the
+// store.
+func (sc *FDStoreClient) Release(name string) error {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	return sc.request(fdStoreRelease, name)
+}
+
+// Close closes the connection to the store. The descriptors deposited are
+// kept in the store.
+func (sc *FDStoreClient) Close() error {
+	return sc.conn.Close()
+}
+
+// request sends the request and receives the reply.
+func (sc *FDStoreClient) request(op uint8, name string) error {
+	if err := sc.conn.sendMessage(&fdStoreRequest{Op: op, Name: name}); err != nil {
+		return err
+	}
+	return sc.receiveReply()
+}
+
+func (sc *FDStoreClient) receiveReply() error {
+	cmd, err := sc.conn.ReceiveCommand()
+	if err != nil {
+		return err
+	}
+	if cmd != DataCommand {
+		return fmt.Errorf("fdstore: unexpected command %v", cmd)
+	}
+
+	var reply fdStoreReply
+	if err := sc.conn.receiveMessage(&reply); err != nil {
+		return err
+	}
+	if reply.OK {
+		return nil
+	}
+
+	if cmd, err = sc.conn.ReceiveCommand(); err != nil {
+		return err
+	}
+	if cmd != DataCommand {
+		return fmt.Errorf("fdstore: unexpected command %v", cmd)
+	}
+	return sc.conn.receiveError()
+}
+
+// Operations of fdStoreRequest.
+const (
+	fdStoreDeposit = iota + 1
+	fdStoreFetch
+	fdStoreList
+	fdStoreRelease
+)
+
+type fdStoreRequest struct {
+	Op   uint8
+	Name string
+	Meta []byte
+}
+
+func (r *fdStoreRequest) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(r.Op)
+	bw.writeBytes([]byte(r.Name))
+	bw.writeBytes(r.Meta)
+	return bw.err
+}
+
+func (r *fdStoreRequest) deserialize(rd io.Reader) error {
+	br := &bytesReader{rd, nil}
+	br.read(&r.Op)
+	r.Name = string(br.readBytes())
+	r.Meta = br.readBytes()
+	return br.err
+}
+
+// fdStoreReply precedes the result of a request; an error message follows if
+// not OK.
+type fdStoreReply struct {
+	OK bool
+}
+
+func (r *fdStoreReply) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(r.OK)
+	return bw.err
+}
+
+func (r *fdStoreReply) deserialize(rd io.Reader) error {
+	br := &bytesReader{rd, nil}
+	br.read(&r.OK)
+	return br.err
+}
+
+type fdStoreListMessage struct {
+	Entries []FDStoreEntry
+}
+
+func (m *fdStoreListMessage) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(uint32(len(m.Entries)))
+	for _, e := range m.Entries {
+		bw.writeBytes([]byte(e.Name))
+		bw.writeBytes(e.Meta)
+	}
+	return bw.err
+}
+
+func (m *fdStoreListMessage) deserialize(r io.Reader) error {
+	br := &bytesReader{r, nil}
+	var n uint32
+	br.read(&n)
+	for i := uint32(0); i < n && br.err == nil; i++ {
+		var e FDStoreEntry
+		e.Name = string(br.readBytes())
+		e.Meta = br.readBytes()
+		m.Entries = append(m.Entries, e)
+	}
+	return br.err
+}
@@ -0,0 +1,109 @@
+package ipc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestFDStore(t *testing.T) {
+	store := NewFDStore()
+	store.MaxEntries = 2
+	defer store.Close()
+
+	connect := func(pipename string) *FDStoreClient {
+		conn, client := connPair(t, pipename)
+		go func() {
+			defer conn.Close()
+			store.ServeConn(conn)
+		}()
+		return NewFDStoreClient(client)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	f, err := ioutil.TempFile("", "go-ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("state")
+
+	// the first worker deposits and crashes
+	sc := connect("a")
+	if err := sc.Deposit("web", l.(*net.TCPListener), []byte("v1")); err != nil {
+		t.Fatalf("Deposit error: %v", err)
+	}
+	if err := sc.Deposit("state", f, nil); err != nil {
+		t.Fatalf("Deposit error: %v", err)
+	}
+	if err := sc.Deposit("web", l.(*net.TCPListener), nil); !os.IsExist(err) {
+		t.Errorf("got error `%v` but want `%v`", err, os.ErrExist)
+	}
+	if err := sc.Deposit("extra", l.(*net.TCPListener), nil); err != ErrFDStoreFull {
+		t.Errorf("got error `%v` but want `%v`", err, ErrFDStoreFull)
+	}
+	l.Close()
+	f.Close()
+	sc.Close()
+
+	// the replacement fetches
+	sc = connect("a")
+	defer sc.Close()
+
+	entries, err := sc.List()
+	if err != nil {
+		t.Fatalf("List error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d entries but want 2", len(entries))
+	}
+
+	l, meta, err := sc.FetchListener("web")
+	if err != nil {
+		t.Fatalf("FetchListener error: %v", err)
+	}
+	defer l.Close()
+	if string(meta) != "v1" || l.Addr().String() != addr {
+		t.Errorf("got %s with meta %q", l.Addr(), meta)
+	}
+	go func() {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error: %v", err)
+	}
+	c.Close()
+
+	sf, _, err := sc.Fetch("state")
+	if err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	defer sf.Close()
+	sf.Seek(0, 0)
+	if b, _ := ioutil.ReadAll(sf); string(b) != "state" {
+		t.Errorf("got %q but want %q", b, "state")
+	}
+
+	if err := sc.Release("web"); err != nil {
+		t.Fatalf("Release error: %v", err)
+	}
+	if _, _, err := sc.Fetch("web"); !os.IsNotExist(err) {
+		t.Errorf("got error `%v` but want `%v`", err, os.ErrNotExist)
+	}
+	if err := sc.Release("web"); !os.IsNotExist(err) {
+		t.Errorf("got error `%v` but want `%v`", err, os.ErrNotExist)
+	}
+
+	// a released entry makes room
+	if err := sc.Deposit("extra", sf, nil); err != nil {
+		t.Errorf("Deposit error: %v", err)
+	}
+}
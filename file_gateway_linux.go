@@ -4,16 +4,22 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 type fileData struct {
 	Name     string
+	Access   FileAccess
 	withData bool
 }
 
 func (f *fileData) serialize(w io.Writer) error {
 	bw := &bytesWriter{w, nil}
 	bw.writeBytes([]byte(f.Name))
+	bw.write(int32(f.Access))
 	bw.write(f.withData)
 	return bw.err
 }
@@ -23,6 +29,9 @@ func (f *fileData) deserialize(r io.Reader) error {
 	if b := br.readBytes(); b != nil {
 		f.Name = string(b)
 	}
+	var i32 int32
+	br.read(&i32)
+	f.Access = FileAccess(i32)
 	br.read(&f.withData)
 	return br.err
 }
@@ -31,17 +40,27 @@ type fileGateway struct {
 	gateway
 }
 
-func (gw *fileGateway) send(conn net.Conn, f *os.File, msg []byte) (err error) {
+func (gw *fileGateway) send(conn net.Conn, f *os.File, access FileAccess, msg []byte) (err error) {
 	rawFile, err := f.SyscallConn()
 	if err != nil {
 		return
 	}
 
 	rawFile.Control(func(fd uintptr) {
+		sendFd := int(fd)
+		if access != FullAccess {
+			sendFd, err = restrictFile(sendFd, access)
+			if err != nil {
+				return
+			}
+			defer unix.Close(sendFd)
+		}
+
 		err = gw.sendImpl(conn,
-			int(fd),
+			sendFd,
 			&fileData{
 				Name:     f.Name(),
+				Access:   access,
 				withData: len(msg) > 0,
 			},
 			msg)
@@ -53,16 +72,84 @@ func (gw *fileGateway) send(conn net.Conn, f *os.File, msg []byte) (err error) {
 	return
 }
 
-func (gw *fileGateway) receive(conn net.Conn) (f *os.File, withData bool, err error) {
+func (gw *fileGateway) receive(conn net.Conn) (f *os.File, access FileAccess, withData bool, err error) {
 	var fdata fileData
 	fd, err := gw.receiveImpl(conn, &fdata)
 	if err != nil {
 		return
 	}
 
-	return os.NewFile(uintptr(fd), fdata.Name), fdata.withData, nil
+	return os.NewFile(uintptr(fd), fdata.Name), fdata.Access, fdata.withData, nil
 }
 
 func newFileGateway() *fileGateway {
 	return &fileGateway{}
 }
+
+// checkFileAccess returns EBADF unless access is a subset of the access mode f
+// was opened with; the reopen by restrictFile would grant more than the sender
+// has otherwise.
+func checkFileAccess(f *os.File, access FileAccess) error {
+	if access == FullAccess {
+		return nil
+	}
+
+	rawFile, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fl int
+	if cerr := rawFile.Control(func(fd uintptr) {
+		fl, err = unix.FcntlInt(fd, unix.F_GETFL, 0)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	mode := fl & unix.O_ACCMODE
+	if (access&ReadOnly != 0 && mode == unix.O_WRONLY) ||
+		(access&AppendOnly != 0 && mode == unix.O_RDONLY) {
+		return unix.EBADF
+	}
+	return nil
+}
+
+// restrictFile opens a new file descriptor of fd with the reduced access.
+func restrictFile(fd int, access FileAccess) (int, error) {
+	var flags int
+	switch access {
+	case ReadOnly:
+		flags = unix.O_RDONLY
+	case AppendOnly:
+		flags = unix.O_WRONLY | unix.O_APPEND
+	case ReadOnly | AppendOnly:
+		flags = unix.O_RDWR | unix.O_APPEND
+	default:
+		return -1, unix.EINVAL
+	}
+
+	path := "/proc/self/fd/" + strconv.Itoa(fd)
+	if target, err := os.Readlink(path); err == nil && strings.HasPrefix(target, "/memfd:") {
+		if err := sealMemfd(fd, access); err != nil {
+			return -1, err
+		}
+	}
+
+	return unix.Open(path, flags|unix.O_CLOEXEC, 0)
+}
+
+func sealMemfd(fd int, access FileAccess) error {
+	seals := unix.F_SEAL_SHRINK
+	if access&AppendOnly == 0 {
+		seals |= unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+	}
+
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, seals)
+	if err == unix.EPERM {
+		// created without MFD_ALLOW_SEALING; passed without seals
+		return nil
+	}
+	return err
+}
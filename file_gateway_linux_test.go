@@ -0,0 +1,132 @@
+package ipc
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSendFileWithAccess(t *testing.T) {
+	conn, client := connPair(t, "a")
+	defer conn.Close()
+	defer client.Close()
+
+	receive := func(t *testing.T) (*os.File, FileAccess) {
+		cmd, err := client.ReceiveCommand()
+		if err != nil {
+			t.Fatalf("ReceiveCommand error: %v", err)
+		}
+		if got, want := cmd, FileCommand; got != want {
+			t.Fatalf("got command %v, but want %v", got, want)
+		}
+		f, access, _, err := client.ReceiveFileWithAccess()
+		if err != nil {
+			t.Fatalf("ReceiveFileWithAccess error: %v", err)
+		}
+		return f, access
+	}
+
+	t.Run("read only file", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "ipc-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := f.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := conn.SendFileWithAccess(f, ReadOnly, nil); err != nil {
+			t.Fatalf("SendFileWithAccess error: %v", err)
+		}
+		rf, access := receive(t)
+		defer rf.Close()
+
+		if got, want := access, ReadOnly; got != want {
+			t.Errorf("got access %v but want %v", got, want)
+		}
+		if _, err := rf.Write([]byte("x")); err == nil {
+			t.Errorf("write to read only file succeeded")
+		}
+		b, err := ioutil.ReadAll(rf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "content"; got != want {
+			t.Errorf("got content %q but want %q", got, want)
+		}
+	})
+
+	t.Run("append only file", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "ipc-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		if err := conn.SendFileWithAccess(f, AppendOnly, nil); err != nil {
+			t.Fatalf("SendFileWithAccess error: %v", err)
+		}
+		rf, access := receive(t)
+		defer rf.Close()
+
+		if got, want := access, AppendOnly; got != want {
+			t.Errorf("got access %v but want %v", got, want)
+		}
+		if _, err := rf.Read(make([]byte, 1)); err == nil {
+			t.Errorf("read from append only file succeeded")
+		}
+		if _, err := rf.Write([]byte("x")); err != nil {
+			t.Errorf("write error: %v", err)
+		}
+	})
+
+	t.Run("access beyond the file is refused", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "ipc-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.Close()
+
+		wf, err := os.OpenFile(f.Name(), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer wf.Close()
+
+		if got, want := conn.SendFileWithAccess(wf, ReadOnly, nil), unix.EBADF; got != want {
+			t.Errorf("got error `%v` but want `%v`", got, want)
+		}
+	})
+
+	t.Run("read only memfd is sealed", func(t *testing.T) {
+		fd, err := unix.MemfdCreate("ipc-test", unix.MFD_ALLOW_SEALING)
+		if err != nil {
+			t.Skipf("memfd is not supported: %v", err)
+		}
+		f := os.NewFile(uintptr(fd), "memfd")
+		defer f.Close()
+
+		if err := conn.SendFileWithAccess(f, ReadOnly, nil); err != nil {
+			t.Fatalf("SendFileWithAccess error: %v", err)
+		}
+		rf, _ := receive(t)
+		defer rf.Close()
+
+		seals, err := unix.FcntlInt(rf.Fd(), unix.F_GET_SEALS, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seals&unix.F_SEAL_WRITE == 0 {
+			t.Errorf("F_SEAL_WRITE is not set: seals=%#x", seals)
+		}
+		if _, err := f.Write([]byte("x")); err == nil {
+			t.Errorf("write to sealed memfd succeeded")
+		}
+	})
+}
@@ -11,6 +11,7 @@ import (
 type fileData struct {
 	Handle   windows.Handle
 	Name     string
+	Access   FileAccess
 	withData bool
 }
 
@@ -18,6 +19,7 @@ func (f *fileData) serialize(w io.Writer) error {
 	bw := &bytesWriter{w, nil}
 	bw.write(uint64(f.Handle))
 	bw.writeBytes([]byte(f.Name))
+	bw.write(int32(f.Access))
 	bw.write(f.withData)
 	return bw.err
 }
@@ -30,6 +32,9 @@ func (f *fileData) deserialize(r io.Reader) error {
 	if b := br.readBytes(); b != nil {
 		f.Name = string(b)
 	}
+	var i32 int32
+	br.read(&i32)
+	f.Access = FileAccess(i32)
 	br.read(&f.withData)
 	return br.err
 }
@@ -38,7 +43,7 @@ type fileGateway struct {
 	gateway
 }
 
-func (gw *fileGateway) send(conn net.Conn, f *os.File, msg []byte) (err error) {
+func (gw *fileGateway) send(conn net.Conn, f *os.File, access FileAccess, msg []byte) (err error) {
 	rawFile, err := f.SyscallConn()
 	if err != nil {
 		return
@@ -60,17 +65,19 @@ func (gw *fileGateway) send(conn net.Conn, f *os.File, msg []byte) (err error) {
 
 			fdata := fileData{
 				Name:     f.Name(),
+				Access:   access,
 				withData: len(msg) > 0,
 			}
 
+			desiredAccess, options := accessRights(access)
 			err = windows.DuplicateHandle(
 				thisPHandle,
 				windows.Handle(fd),
 				targetPHandle,
 				&fdata.Handle,
-				0,
+				desiredAccess,
 				false,
-				windows.DUPLICATE_SAME_ACCESS)
+				options)
 			if err != nil {
 				return
 			}
@@ -83,13 +90,35 @@ func (gw *fileGateway) send(conn net.Conn, f *os.File, msg []byte) (err error) {
 	return
 }
 
-func (gw *fileGateway) receive(conn net.Conn) (f *os.File, withData bool, err error) {
+func (gw *fileGateway) receive(conn net.Conn) (f *os.File, access FileAccess, withData bool, err error) {
 	var fdata fileData
 	err = gw.receiveImpl(conn, &fdata)
 	if err != nil {
 		return
 	}
-	return os.NewFile(uintptr(fdata.Handle), fdata.Name), fdata.withData, nil
+	return os.NewFile(uintptr(fdata.Handle), fdata.Name), fdata.Access, fdata.withData, nil
+}
+
+// checkFileAccess does nothing on windows; the reduced rights are requested
+// from DuplicateHandle as is.
+func checkFileAccess(f *os.File, access FileAccess) error {
+	return nil
+}
+
+// accessRights returns arguments of DuplicateHandle for the access.
+func accessRights(access FileAccess) (desiredAccess uint32, options uint32) {
+	if access == FullAccess {
+		return 0, windows.DUPLICATE_SAME_ACCESS
+	}
+
+	desiredAccess = windows.SYNCHRONIZE
+	if access&ReadOnly != 0 {
+		desiredAccess |= windows.GENERIC_READ
+	}
+	if access&AppendOnly != 0 {
+		desiredAccess |= windows.FILE_APPEND_DATA
+	}
+	return desiredAccess, 0
 }
 
 func newFileGateway() *fileGateway {
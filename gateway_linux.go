@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -145,3 +146,24 @@ func waitIOEvent(mode, fd int, timeout *unix.Timeval) (bool, error) {
 	}
 	return n == 1, nil
 }
+
+// sendDatagram sends b with fds as a datagram.
+func sendDatagram(conn *net.UnixConn, b []byte, fds []int) (err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var rights []byte
+	if len(fds) > 0 {
+		rights = unix.UnixRights(fds...)
+	}
+	werr := rawConn.Write(func(connFd uintptr) bool {
+		err = unix.Sendmsg(int(connFd), b, rights, nil, 0)
+		return err != unix.EAGAIN
+	})
+	if werr != nil {
+		return werr
+	}
+	return os.NewSyscallError("sendmsg", err)
+}
@@ -0,0 +1,280 @@
+package ipc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HandBack passes a connection back to the Dispatcher, which passes it to
+// another worker; it is the reverse of the passing on shutdown of a worker.
+//
+// conn is a connection received from the dispatcher, either a TCPConn or a
+// *ProxyConn wrapping it. buffered is data already read from conn but not
+// consumed; it is passed ahead of the data unread in conn. conn is closed
+// when the passing is succeeded but not if an error occurs.
+//
+// msg is an additional information. Specify nil if nothing.
+func (c *Conn) HandBack(conn net.Conn, buffered, msg []byte) error {
+	sock, buffered, err := unwrapConn(conn, buffered)
+	if err != nil {
+		return err
+	}
+	// the wrappers of sock hold nothing to be closed
+	return c.sendConn(sock, buffered, msg)
+}
+
+// SendHijacked hijacks the connection of an http.Handler and passes it to the
+// peer as SendTCPConn does. Data the http.Server has read from the client but
+// not consumed is passed as the peeked data, and data written to w is flushed
+// before the passing.
+//
+// The request being handled has been read by the http.Server; it is not
+// passed. Put what the peer needs to know about it into msg.
+//
+// If the hijacking fails, w can be used to reply an error. Otherwise the
+// connection is closed whether the passing is succeeded or not.
+func (c *Conn) SendHijacked(w http.ResponseWriter, msg []byte) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendHijacked(conn, rw, msg); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *Conn) sendHijacked(conn net.Conn, rw *bufio.ReadWriter, msg []byte) error {
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+
+	sock, buffered, err := unwrapConn(conn, buffered)
+	if err != nil {
+		return err
+	}
+	return c.sendConn(sock, buffered, msg)
+}
+
+// unwrapConn returns the socket under conn and the data read from it but not
+// consumed, appended to buffered in the order of the stream. conn is not
+// modified, so that it can still be used if the passing fails; the peeked
+// data of a TCPConn is still returned by its Read.
+func unwrapConn(conn net.Conn, buffered []byte) (net.Conn, []byte, error) {
+	for {
+		switch v := conn.(type) {
+		case *net.TCPConn:
+			return v, buffered, nil
+		case *tcpConn:
+			return v, append(buffered[:len(buffered):len(buffered)], v.peeked...), nil
+		case *ProxyConn:
+			// the dispatcher prepends a new header if configured
+			if _, err := v.ProxyHeader(); err != nil {
+				return nil, nil, err
+			}
+			b, _ := v.r.Peek(v.r.Buffered())
+			buffered = append(buffered, b...)
+			conn = v.Conn
+		case *idleConn:
+			conn = v.Conn
+		case *ReceivedConn:
+			conn = v.TCPConn
+		case *MigratedConn:
+			conn = v.TCPConn
+		default:
+			return nil, nil, fmt.Errorf("unsupported connection %T", conn)
+		}
+	}
+}
+
+// IdleTracker tracks idle keep-alive connections of http.Server so that they
+// can be handed back to the Dispatcher on shutdown of a worker, instead of
+// being closed by http.Server.Shutdown:
+//
+//	t := NewIdleTracker()
+//	srv := &http.Server{ConnState: t.ConnState}
+//	go srv.Serve(t.Listener(ql))
+//	...
+//	t.HandBack(conn, nil)
+//	srv.Shutdown(ctx)
+//
+// Only plain HTTP/1.x connections can be handed back. Data which http.Server
+// buffered before a connection became idle, such as a part of a pipelined
+// request, is lost.
+type IdleTracker struct {
+	m     sync.Mutex
+	conns map[*idleConn]struct{}
+}
+
+// NewIdleTracker creates an IdleTracker.
+func NewIdleTracker() *IdleTracker {
+	return &IdleTracker{conns: make(map[*idleConn]struct{})}
+}
+
+// Listener returns l wrapped so that the accepted connections are tracked.
+func (t *IdleTracker) Listener(l net.Listener) net.Listener {
+	return &idleListener{l}
+}
+
+// ConnState is set to http.Server.ConnState.
+func (t *IdleTracker) ConnState(conn net.Conn, state http.ConnState) {
+	c, ok := conn.(*idleConn)
+	if !ok {
+		return
+	}
+
+	switch state {
+	case http.StateNew:
+		t.m.Lock()
+		t.conns[c] = struct{}{}
+		t.m.Unlock()
+	case http.StateIdle:
+		c.setIdle(true)
+	case http.StateActive:
+		c.setIdle(false)
+	case http.StateHijacked, http.StateClosed:
+		t.m.Lock()
+		delete(t.conns, c)
+		t.m.Unlock()
+	}
+}
+
+// HandBack hands the idle connections back over c with Conn.HandBack, and
+// returns the number of them. http.Server sees them closed by the client.
+//
+// HandBack stops at the first error; the connection failed is closed, and the
+// rest are left to http.Server.
+func (t *IdleTracker) HandBack(c *Conn, msg []byte) (int, error) {
+	t.m.Lock()
+	conns := make([]*idleConn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.m.Unlock()
+
+	n := 0
+	for _, conn := range conns {
+		buffered, ok := conn.steal()
+		if !ok {
+			continue
+		}
+
+		t.m.Lock()
+		delete(t.conns, conn)
+		t.m.Unlock()
+
+		if err := c.HandBack(conn.Conn, buffered, msg); err != nil {
+			conn.Conn.Close()
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+type idleListener struct {
+	net.Listener
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &idleConn{Conn: conn}, nil
+}
+
+// aLongTimeAgo is a deadline to interrupt a blocked Read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// idleConn is a connection tracked by IdleTracker.
+type idleConn struct {
+	net.Conn
+
+	m       sync.Mutex // guard below
+	idle    bool
+	reading bool
+	stolen  bool
+	unread  []byte        // read while idle; not consumed by http.Server
+	left    chan struct{} // closed when Read returns after stolen
+}
+
+func (c *idleConn) setIdle(idle bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.idle = idle
+	c.unread = nil
+}
+
+// Read returns io.EOF once the connection is stolen. Data which raced in is
+// kept to be handed back.
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.m.Lock()
+	if c.stolen {
+		c.m.Unlock()
+		return 0, io.EOF
+	}
+	c.reading = true
+	c.m.Unlock()
+
+	n, err := c.Conn.Read(b)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.reading = false
+	if c.stolen {
+		c.unread = append(c.unread, b[:n]...)
+		close(c.left)
+		return 0, io.EOF
+	}
+	if c.idle {
+		c.unread = append(c.unread, b[:n]...)
+	}
+	return n, err
+}
+
+// Close does not close the stolen connection; it is closed by HandBack.
+func (c *idleConn) Close() error {
+	c.m.Lock()
+	stolen := c.stolen
+	c.m.Unlock()
+
+	if stolen {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// steal takes the connection from http.Server if it is idle and waiting for
+// the next request. It returns the data not consumed by http.Server.
+func (c *idleConn) steal() ([]byte, bool) {
+	c.m.Lock()
+	if !c.idle || !c.reading || c.stolen {
+		c.m.Unlock()
+		return nil, false
+	}
+	c.stolen = true
+	c.left = make(chan struct{})
+	c.m.Unlock()
+
+	// interrupt the Read of http.Server and wait for it
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	<-c.left
+	c.Conn.SetReadDeadline(time.Time{})
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.unread, true
+}
@@ -0,0 +1,151 @@
+package ipc
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type httpWorker struct {
+	conn    *Conn
+	ql      *QueueListener
+	tracker *IdleTracker
+	srv     *http.Server
+}
+
+func startHTTPWorker(t *testing.T, d *Dispatcher, pipename, name string) *httpWorker {
+	master, conn := connPair(t, pipename)
+	d.AddWorker(master)
+
+	w := &httpWorker{conn: conn, ql: NewQueueListener(10), tracker: NewIdleTracker()}
+	w.srv = &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte(name))
+		}),
+		ConnState: w.tracker.ConnState,
+	}
+	go w.ql.Feed(conn)
+	go w.srv.Serve(w.tracker.Listener(w.ql))
+	return w
+}
+
+func (w *httpWorker) stop() {
+	w.srv.Close()
+	w.conn.Close()
+}
+
+func TestHandBack(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(l)
+	defer d.Close()
+	go d.Serve()
+
+	a := startHTTPWorker(t, d, "a", "a")
+	defer a.stop()
+	b := startHTTPWorker(t, d, "b", "b")
+	defer b.stop()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	get := func() string {
+		if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	first := get()
+	w := a
+	if first == "b" {
+		w = b
+	}
+
+	// wait until the server waits for the next request
+	n := 0
+	for i := 0; i < 100 && n == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if n, err = w.tracker.HandBack(w.conn, nil); err != nil {
+			t.Fatalf("HandBack error: %v", err)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("handed back %v connections but want 1", n)
+	}
+
+	if second := get(); second == first {
+		t.Errorf("served by %v again after handed back", second)
+	}
+}
+
+func TestSendHijacked(t *testing.T) {
+	sender, receiver := connPair(t, "a")
+	defer sender.Close()
+	defer receiver.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if err := sender.SendHijacked(rw, []byte(r.URL.Path)); err != nil {
+				t.Errorf("SendHijacked error: %v", err)
+			}
+		}),
+	}
+	defer srv.Close()
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\n\r\nhello"))
+
+	if cmd, err := receiver.ReceiveCommand(); err != nil || cmd != TCPConnCommand {
+		t.Fatalf("ReceiveCommand returned %v, %v", cmd, err)
+	}
+	conn, withData, err := receiver.ReceiveTCPConn()
+	if err != nil {
+		t.Fatalf("ReceiveTCPConn error: %v", err)
+	}
+	defer conn.Close()
+	if !withData {
+		t.Fatal("msg is not passed")
+	}
+	if msg, _ := receiver.ReceiveData(); string(msg) != "/chat" {
+		t.Errorf("got msg %q but want %q", msg, "/chat")
+	}
+
+	// the data buffered by http.Server is passed
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := readAll(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("got %q, %v but want %q", buf, err, "hello")
+	}
+
+	conn.Write([]byte("bye"))
+	if err := readAll(c, buf[:3]); err != nil || string(buf[:3]) != "bye" {
+		t.Errorf("client got %q, %v but want %q", buf[:3], err, "bye")
+	}
+}
@@ -0,0 +1,78 @@
+package ipc
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ConnInfo is the metadata of a TCP connection received from a peer.
+type ConnInfo struct {
+	// Msg is the additional information passed with the connection. It is
+	// filled by QueueListener.Feed and ConnListener; ReceiveTCPConn leaves it
+	// nil since the message is received separately.
+	Msg []byte
+
+	// SenderPID is the process id of the sender, or 0 if unknown.
+	SenderPID int
+
+	// SentAt is the time the sender passed the connection, and ReceivedAt is
+	// the time it was received.
+	SentAt     time.Time
+	ReceivedAt time.Time
+
+	// LocalAddr and RemoteAddr are the addresses of the client connection;
+	// they are not replaced by wrappers such as ProxyConn.
+	LocalAddr  net.TCPAddr
+	RemoteAddr net.TCPAddr
+}
+
+// HandoffInfo returns the metadata of a connection received from a peer. conn
+// may be wrapped, e.g. by ConnListener, ReceiveMigration, ProxyListener,
+// IdleTracker or crypto/tls. It returns false if conn was not received from a
+// peer.
+func HandoffInfo(conn net.Conn) (*ConnInfo, bool) {
+	for {
+		switch v := conn.(type) {
+		case *tcpConn:
+			return v.info, v.info != nil
+		case *ReceivedConn:
+			conn = v.TCPConn
+		case *MigratedConn:
+			conn = v.TCPConn
+		case *ProxyConn:
+			conn = v.Conn
+		case *idleConn:
+			conn = v.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = v.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+type connInfoKey struct{}
+
+// ConnContext stores the metadata of c into ctx; it is set to
+// http.Server.ConnContext so that handlers can get the metadata with
+// HandoffInfoFromContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if info, ok := HandoffInfo(c); ok {
+		return context.WithValue(ctx, connInfoKey{}, info)
+	}
+	return ctx
+}
+
+// HandoffInfoFromContext returns the metadata stored by ConnContext.
+func HandoffInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(*ConnInfo)
+	return info, ok
+}
+
+// setHandoffMsg sets msg to the metadata of conn.
+func setHandoffMsg(conn net.Conn, msg []byte) {
+	if info, ok := HandoffInfo(conn); ok {
+		info.Msg = msg
+	}
+}
@@ -0,0 +1,57 @@
+package ipc
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHandoffInfo(t *testing.T) {
+	master, worker := connPair(t, "a")
+	defer master.Close()
+
+	l := NewConnListener(worker, nil)
+	defer l.Close()
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, ok := HandoffInfoFromContext(r.Context())
+			if !ok {
+				http.Error(w, "no info", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(string(info.Msg) + " " + strconv.Itoa(info.SenderPID) + " " + info.RemoteAddr.String()))
+		}),
+		ConnContext: ConnContext,
+	}
+	defer srv.Close()
+	go srv.Serve(NewProxyListener(l))
+
+	server, client := tcpPair(t)
+	defer client.Close()
+	hdr, _ := AppendProxyHeader(nil, 1,
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234},
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80})
+	if err := master.SendTCPConn(server, hdr, []byte("tenant")); err != nil {
+		t.Fatalf("SendTCPConn error: %v", err)
+	}
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// the addresses are of the client connection, not of the PROXY header
+	want := "tenant " + strconv.Itoa(os.Getpid()) + " " + client.LocalAddr().String()
+	if string(body) != want {
+		t.Errorf("got %q but want %q", body, want)
+	}
+}
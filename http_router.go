@@ -0,0 +1,181 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrHeaderTooLarge is given to HTTPRouter.Fallback when the request
+	// header exceeds MaxHeaderBytes.
+	ErrHeaderTooLarge = errors.New("request header too large")
+
+	// ErrBadRequest is given to HTTPRouter.Fallback when the request is not
+	// HTTP/1.x.
+	ErrBadRequest = errors.New("bad request")
+)
+
+// HTTPRoute routes requests to the workers of Group.
+//
+// Host matches the Host header without the port, ignoring case; "*.example.com"
+// matches any subdomain of example.com. PathPrefix matches the beginning of
+// the request path. Empty Host or PathPrefix matches any request.
+type HTTPRoute struct {
+	Host       string
+	PathPrefix string
+	Group      string
+}
+
+func (r *HTTPRoute) match(host, path string) bool {
+	if r.Host != "" && !matchHost(r.Host, host) {
+		return false
+	}
+	return strings.HasPrefix(path, r.PathPrefix)
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return len(host) > len(pattern)-1 &&
+			strings.EqualFold(host[len(host)-len(pattern)+1:], pattern[1:])
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// Default limits of HTTPRouter.
+const (
+	DefaultMaxHeaderBytes = 16 << 10
+	DefaultPeekTimeout    = 10 * time.Second
+)
+
+// HTTPRouter selects a worker by the Host header or the path of HTTP/1.x
+// requests. It reads the request line and the headers in Peek, and they are
+// passed to the worker as the peeked data. Use it with a Dispatcher:
+//
+//	d.Peek = router.Peek
+//	d.Balancer = router
+//
+// Routes are examined in order and the first match decides the group. If no
+// route matches, or the group has no worker, the connection is closed.
+type HTTPRouter struct {
+	Routes []HTTPRoute
+
+	// Balancer selects a worker in the group. If nil, RoundRobin is used.
+	Balancer Balancer
+
+	// MaxHeaderBytes limits the size of the request line and the headers.
+	// If zero, DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+
+	// Timeout limits the time to read the headers. If zero,
+	// DefaultPeekTimeout is used.
+	Timeout time.Duration
+
+	// Fallback is called with a connection whose request could not be parsed,
+	// instead of replying 400 Bad Request (or 431 if the headers are too
+	// large). The connection is closed after Fallback returns.
+	Fallback func(conn net.Conn, peeked []byte, err error)
+
+	roundRobin roundRobin
+}
+
+// Peek reads the request line and the headers from conn. It may read a part
+// of the body too. See Dispatcher.Peek.
+func (r *HTTPRouter) Peek(conn net.Conn) ([]byte, error) {
+	max := r.MaxHeaderBytes
+	if max == 0 {
+		max = DefaultMaxHeaderBytes
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultPeekTimeout
+	}
+
+	peeked, err := peekConn(conn, max, timeout, func(b []byte) bool {
+		return bytes.Contains(b, []byte("\r\n\r\n"))
+	})
+	if err == errPeekTooLarge {
+		return nil, r.fail(conn, peeked, ErrHeaderTooLarge)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := parseHTTPRequest(peeked); err != nil {
+		return nil, r.fail(conn, peeked, err)
+	}
+	return peeked, nil
+}
+
+// fail replies an error or calls Fallback, and returns err.
+func (r *HTTPRouter) fail(conn net.Conn, peeked []byte, err error) error {
+	if r.Fallback != nil {
+		r.Fallback(conn, peeked, err)
+		return err
+	}
+
+	status := http.StatusBadRequest
+	if err == ErrHeaderTooLarge {
+		status = http.StatusRequestHeaderFieldsTooLarge
+	}
+	text := http.StatusText(status)
+	conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + text + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Connection: close\r\n\r\n" +
+		strconv.Itoa(status) + " " + text))
+	return err
+}
+
+// Pick implements the Balancer interface; it selects a worker of the group
+// routed by the request in peeked.
+func (r *HTTPRouter) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	req, err := parseHTTPRequest(peeked)
+	if err != nil {
+		return nil
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for i := range r.Routes {
+		if r.Routes[i].match(host, req.URL.Path) {
+			return pickGroup(r.Balancer, &r.roundRobin, r.Routes[i].Group, workers, client, peeked)
+		}
+	}
+	return nil
+}
+
+// pickGroup selects a worker of the group with b, or rr if b is nil.
+func pickGroup(b Balancer, rr *roundRobin, group string, workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	var members []*Worker
+	for _, w := range workers {
+		if w.Group() == group {
+			members = append(members, w)
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	if b == nil {
+		return rr.Pick(members, client, peeked)
+	}
+	return b.Pick(members, client, peeked)
+}
+
+func parseHTTPRequest(peeked []byte) (*http.Request, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(peeked)))
+	if err != nil {
+		return nil, ErrBadRequest
+	}
+	if req.ProtoMajor != 1 {
+		return nil, ErrBadRequest
+	}
+	return req, nil
+}
@@ -0,0 +1,122 @@
+package ipc
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// tcpPair returns a pair of connected TCP connections: the accepted one and
+// the dialed one.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accepted.(*net.TCPConn), dialed.(*net.TCPConn)
+}
+
+func TestHTTPRouter(t *testing.T) {
+	ws := newTestingWorkers(3)
+	ws[0].SetGroup("api")
+	ws[1].SetGroup("static")
+	ws[2].SetGroup("web")
+
+	r := &HTTPRouter{
+		Routes: []HTTPRoute{
+			{Host: "api.example.com", Group: "api"},
+			{Host: "*.example.org", PathPrefix: "/static/", Group: "static"},
+			{Host: "www.example.com", Group: "web"},
+		},
+	}
+
+	var tests = []struct {
+		name    string
+		request string
+		want    *Worker
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: API.example.com:8080\r\n\r\n", ws[0]},
+		{"wildcard host and path", "GET /static/a.png HTTP/1.1\r\nHost: cdn.example.org\r\n\r\n", ws[1]},
+		{"path does not match", "GET /index.html HTTP/1.1\r\nHost: cdn.example.org\r\n\r\n", nil},
+		{"with body", "POST / HTTP/1.1\r\nHost: www.example.com\r\nContent-Length: 4\r\n\r\nbody", ws[2]},
+		{"no route", "GET / HTTP/1.0\r\n\r\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := tcpPair(t)
+			defer server.Close()
+			defer client.Close()
+
+			if _, err := client.Write([]byte(tt.request)); err != nil {
+				t.Fatal(err)
+			}
+			peeked, err := r.Peek(server)
+			if err != nil {
+				t.Fatalf("Peek error: %v", err)
+			}
+			if !strings.HasPrefix(tt.request, string(peeked)) {
+				t.Errorf("peeked %q is not a part of the request", peeked)
+			}
+
+			got := r.Pick(ws, client.LocalAddr().(*net.TCPAddr), peeked)
+			if got != tt.want {
+				t.Errorf("got worker %v but want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("bad request", func(t *testing.T) {
+		var tests = []struct {
+			request string
+			status  string
+		}{
+			{"HELLO\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+			{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+			{"GET / HTTP/1.1\r\nX: " + strings.Repeat("x", 100) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		}
+		r := &HTTPRouter{MaxHeaderBytes: 64}
+		for _, tt := range tests {
+			server, client := tcpPair(t)
+			client.Write([]byte(tt.request))
+			if _, err := r.Peek(server); err == nil {
+				t.Errorf("%q: expected error but returned nil", tt.request)
+			}
+			server.Close()
+
+			res, _ := ioutil.ReadAll(client)
+			client.Close()
+			if !strings.HasPrefix(string(res), tt.status) {
+				t.Errorf("%q: got response %q but want %q", tt.request, res, tt.status)
+			}
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		var called error
+		r := &HTTPRouter{Fallback: func(conn net.Conn, peeked []byte, err error) {
+			called = err
+		}}
+
+		server, client := tcpPair(t)
+		defer server.Close()
+		defer client.Close()
+		client.Write([]byte("HELLO\r\n\r\n"))
+		if _, err := r.Peek(server); err != ErrBadRequest {
+			t.Errorf("got error `%v` but want `%v`", err, ErrBadRequest)
+		}
+		if called != ErrBadRequest {
+			t.Errorf("Fallback is called with `%v` but want `%v`", called, ErrBadRequest)
+		}
+	})
+}
@@ -6,9 +6,14 @@ package ipc
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Command represents a IPC command.
@@ -19,11 +24,56 @@ const (
 	DataCommand Command = iota
 	FileCommand
 	TCPConnCommand
+	ListenerCommand
+	PacketConnCommand
+	AckCommand
 )
 
+var commandNames = map[Command]string{
+	DataCommand:       "data",
+	FileCommand:       "file",
+	TCPConnCommand:    "tcpconn",
+	ListenerCommand:   "listener",
+	PacketConnCommand: "packetconn",
+	AckCommand:        "ack",
+}
+
+// String returns the name of the command used in a policy file.
+func (c Command) String() string {
+	if name, ok := commandNames[c]; ok {
+		return name
+	}
+	return "command(" + strconv.Itoa(int(c)) + ")"
+}
+
+func commandByName(name string) (Command, bool) {
+	for c, n := range commandNames {
+		if n == name {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
 // Listener is a IPC listener; it implements net.Listener interface.
 type Listener struct {
-	l net.Listener
+	l      net.Listener
+	pm     sync.Mutex // protect policy
+	policy *Policy
+}
+
+// SetPolicy sets the access-control policy applied to every Conn accepted
+// after the call. Specify nil to disable the access control.
+func (l *Listener) SetPolicy(p *Policy) {
+	l.pm.Lock()
+	l.policy = p
+	l.pm.Unlock()
+}
+
+func (l *Listener) getPolicy() *Policy {
+	l.pm.Lock()
+	defer l.pm.Unlock()
+	return l.policy
 }
 
 // Close implements the Close method in the net.Listener interface; it stop the
@@ -33,10 +83,39 @@ func (l *Listener) Close() error {
 }
 
 // Conn is a IPC connection; it implements net.Conn interface.
+//
+// The Send methods and Write can be called concurrently; each command is
+// written as a whole.
 type Conn struct {
 	conn     net.Conn
 	socketGW *socketGateway
 	fileGW   *fileGateway
+	lisGW    *listenerGateway
+	pm       sync.Mutex // protect policy and peer
+	policy   *Policy
+	peer     *Peer
+	lm       sync.Mutex // protect limiter and its state
+	limiter  *limiter
+	acks     ackTable
+	wm       sync.Mutex // serialize writes of commands
+}
+
+// SetPolicy sets the access-control policy of the connection. Specify nil to
+// disable the access control.
+//
+// Each Send method fails with ErrNotPermitted if the peer is not permitted to
+// receive the command. If the peer sends a command it is not permitted to
+// send, ReceiveCommand closes the connection and returns ErrNotPermitted.
+func (c *Conn) SetPolicy(p *Policy) {
+	c.pm.Lock()
+	c.policy = p
+	c.pm.Unlock()
+}
+
+func (c *Conn) getPolicy() *Policy {
+	c.pm.Lock()
+	defer c.pm.Unlock()
+	return c.policy
 }
 
 // Close implements the Close method in the net.Listener interface; it close the
@@ -47,12 +126,22 @@ func (c *Conn) Close() error {
 
 // SendData sends byte array to the peer. See also ReceiveData.
 func (c *Conn) SendData(d []byte) error {
+	if err := c.checkAccess(AccessReceive, DataCommand); err != nil {
+		return err
+	}
+	if err := c.acquire(false); err != nil {
+		return err
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
 	b := [1]byte{byte(DataCommand)}
 	if _, err := c.conn.Write(b[:]); err != nil {
 		return err
 	}
 
-	return writeData(d, c)
+	return writeData(d, c.conn)
 }
 
 // ReceiveDataLen receives data length from the peer.
@@ -91,11 +180,52 @@ func (c *Conn) ReceiveData() ([]byte, error) {
 //
 // See also ReceiveFile.
 func (c *Conn) SendFile(f *os.File, msg []byte) error {
+	return c.SendFileWithAccess(f, FullAccess, msg)
+}
+
+// FileAccess is an access mode of a file passed by SendFileWithAccess.
+type FileAccess int
+
+// Kinds of FileAccess. ReadOnly|AppendOnly grants reading and appending.
+const (
+	// FullAccess passes the file with all of its access rights.
+	FullAccess FileAccess = 0
+	// ReadOnly passes the file for reading only.
+	ReadOnly FileAccess = 1
+	// AppendOnly passes the file for appending only.
+	AppendOnly FileAccess = 2
+)
+
+// SendFileWithAccess passes the file handle to the peer with the reduced
+// access rights. f itself is handled as SendFile does.
+//
+// On linux, the file is reopened through /proc/self/fd with the reduced flags;
+// EBADF is returned and nothing is sent if access is not a subset of the mode
+// f was opened with. A memfd created with MFD_ALLOW_SEALING is also sealed so
+// that its content can not be changed (ReadOnly) or truncated (AppendOnly)
+// anymore; note the seals apply to the sender too. On windows, the handle is
+// duplicated with the reduced access rights.
+//
+// See also ReceiveFileWithAccess.
+func (c *Conn) SendFileWithAccess(f *os.File, access FileAccess, msg []byte) error {
+	if err := c.checkAccess(AccessReceive, FileCommand); err != nil {
+		return err
+	}
+	if err := checkFileAccess(f, access); err != nil {
+		return err
+	}
+	if err := c.acquire(true); err != nil {
+		return err
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
 	buf := [1]byte{byte(FileCommand)}
 	if _, err := c.conn.Write(buf[:]); err != nil {
 		return err
 	}
-	return c.fileGW.send(c.conn, f, msg)
+	return c.fileGW.send(c.conn, f, access, msg)
 }
 
 // ReceiveFile receives a file handle from the peer.
@@ -105,6 +235,13 @@ func (c *Conn) SendFile(f *os.File, msg []byte) error {
 //
 // See also SendFile.
 func (c *Conn) ReceiveFile() (*os.File, bool, error) {
+	f, _, withData, err := c.fileGW.receive(c.conn)
+	return f, withData, err
+}
+
+// ReceiveFileWithAccess is like ReceiveFile but also returns the access mode
+// the peer granted. See also SendFileWithAccess.
+func (c *Conn) ReceiveFileWithAccess() (*os.File, FileAccess, bool, error) {
 	return c.fileGW.receive(c.conn)
 }
 
@@ -119,22 +256,152 @@ func (c *Conn) ReceiveFile() (*os.File, bool, error) {
 //
 // See also ReceiveTCPConn.
 func (c *Conn) SendTCPConn(conn *net.TCPConn, peeked, msg []byte) error {
+	return c.sendConn(conn, peeked, msg)
+}
+
+// sendConn is SendTCPConn for a *net.TCPConn or a TCPConn received from a
+// peer.
+func (c *Conn) sendConn(conn net.Conn, peeked, msg []byte) error {
+	if err := c.sendSocket(conn, peeked, msg); err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// sendSocket passes conn to the peer and leaves it open.
+func (c *Conn) sendSocket(conn net.Conn, peeked, msg []byte) error {
+	if err := c.checkAccess(AccessReceive, TCPConnCommand); err != nil {
+		return err
+	}
+	if err := c.acquire(true); err != nil {
+		return err
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
 	buf := [1]byte{byte(TCPConnCommand)}
 	if _, err := c.conn.Write(buf[:]); err != nil {
 		return err
 	}
-	return c.socketGW.send(c.conn, conn, peeked, msg)
+	return c.socketGW.send(c.conn, conn, peeked, msg, 0, time.Time{})
 }
 
 // ReceiveTCPConn receives a TCP connection from the peer. The second return
 // value indicate trailing data exists; call ReceiveData to receive it.
-// See also SendTCPConn
+//
+// If the peer passed the connection with SendTCPConnWithAck, it is accepted
+// immediately. See also SendTCPConn and ReceiveTCPConnWithAck.
 func (c *Conn) ReceiveTCPConn() (TCPConn, bool, error) {
-	sock, laddr, raddr, ld, withData, err := c.socketGW.receive(c.conn)
+	conn, h, withData, err := c.ReceiveTCPConnWithAck()
 	if err != nil {
 		return nil, false, err
 	}
-	return newTCPConn(sock, laddr, raddr, ld), withData, nil
+	if h != nil {
+		if err := h.Accept(); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+	}
+	return conn, withData, nil
+}
+
+// SendListener passes a listening socket to the peer. l must be a
+// *net.TCPListener or a *net.UnixListener; it is closed when the passing is
+// succeeded but not if an error occurs. The socket file of a *net.UnixListener
+// is not removed by the close.
+//
+// msg is an additional information. Specify nil if nothing.
+//
+// It is not supported on windows. See also ReceiveListener.
+func (c *Conn) SendListener(l net.Listener, msg []byte) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unsupported listener %T", l)
+	}
+	if err := c.sendListener(l, sc, msg); err != nil {
+		return err
+	}
+
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return l.Close()
+}
+
+// sendListener is SendListener without closing l.
+func (c *Conn) sendListener(l net.Listener, sc syscall.Conn, msg []byte) error {
+	// nothing must be written if unsupported; the peer expects the socket
+	// after the command
+	if !c.lisGW.supported() {
+		return ErrNotSupported
+	}
+	if err := c.checkAccess(AccessReceive, ListenerCommand); err != nil {
+		return err
+	}
+	if err := c.acquire(true); err != nil {
+		return err
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	buf := [1]byte{byte(ListenerCommand)}
+	if _, err := c.conn.Write(buf[:]); err != nil {
+		return err
+	}
+	return c.lisGW.send(c.conn, sc, l.Addr(), msg)
+}
+
+// ReceiveListener receives a listening socket from the peer. The second
+// return value indicate trailing data exists; call ReceiveData to receive it.
+//
+// See also SendListener.
+func (c *Conn) ReceiveListener() (net.Listener, bool, error) {
+	return c.lisGW.receiveListener(c.conn)
+}
+
+// SendPacketConn passes a packet-oriented socket, such as *net.UDPConn, to the
+// peer. pc is closed when the passing is succeeded but not if an error occurs.
+//
+// msg is an additional information. Specify nil if nothing.
+//
+// It is not supported on windows. See also ReceivePacketConn.
+func (c *Conn) SendPacketConn(pc net.PacketConn, msg []byte) error {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unsupported packet conn %T", pc)
+	}
+	if !c.lisGW.supported() {
+		return ErrNotSupported
+	}
+	if err := c.checkAccess(AccessReceive, PacketConnCommand); err != nil {
+		return err
+	}
+	if err := c.acquire(true); err != nil {
+		return err
+	}
+
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	buf := [1]byte{byte(PacketConnCommand)}
+	if _, err := c.conn.Write(buf[:]); err != nil {
+		return err
+	}
+	if err := c.lisGW.send(c.conn, sc, pc.LocalAddr(), msg); err != nil {
+		return err
+	}
+	return pc.Close()
+}
+
+// ReceivePacketConn receives a packet-oriented socket from the peer. The
+// second return value indicate trailing data exists; call ReceiveData to
+// receive it.
+//
+// See also SendPacketConn.
+func (c *Conn) ReceivePacketConn() (net.PacketConn, bool, error) {
+	return c.lisGW.receivePacketConn(c.conn)
 }
 
 // ReceiveCommand receives a command from the peer; it bocks until receives any
@@ -144,12 +411,39 @@ func (c *Conn) ReceiveTCPConn() (TCPConn, bool, error) {
 //   DataCommand: The peer called SendData
 //   FileCommand: The peer called SendFile
 //   TCPConnCommand: The peer called SendTCPConn
+//   ListenerCommand: The peer called SendListener
+//   PacketConnCommand: The peer called SendPacketConn
+//
+// If a policy is set and the peer is not permitted to send the command, the
+// connection is closed and ErrNotPermitted is returned.
+//
+// Acknowledgements to SendTCPConnWithAck are consumed by ReceiveCommand; they
+// are never returned.
 func (c *Conn) ReceiveCommand() (Command, error) {
-	var b [1]byte
-	if _, err := c.conn.Read(b[:]); err != nil {
-		return 0, err
+	for {
+		var b [1]byte
+		if _, err := c.conn.Read(b[:]); err != nil {
+			c.acks.fail(err)
+			return 0, err
+		}
+
+		cmd := Command(b[0])
+		if cmd == AckCommand {
+			if err := c.receiveAck(); err != nil {
+				c.acks.fail(err)
+				return 0, err
+			}
+			continue
+		}
+
+		if err := c.checkAccess(AccessSend, cmd); err != nil {
+			// the payload can not be skipped safely; drop the peer
+			c.conn.Close()
+			c.acks.fail(err)
+			return 0, err
+		}
+		return cmd, nil
 	}
-	return Command(b[0]), nil
 }
 
 // Read implements the Read method in the net.Conn interface.
@@ -159,6 +453,8 @@ func (c *Conn) Read(b []byte) (int, error) {
 
 // Write implements the Write method in the net.Conn interface.
 func (c *Conn) Write(b []byte) (int, error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
 	return c.conn.Write(b)
 }
 
@@ -167,6 +463,7 @@ func newConn(conn net.Conn) *Conn {
 		conn:     conn,
 		socketGW: newSocketGateway(),
 		fileGW:   newFileGateway(),
+		lisGW:    newListenerGateway(),
 	}
 }
 
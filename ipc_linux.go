@@ -2,8 +2,14 @@ package ipc
 
 import "net"
 
-// Listen announces on the pipe name.
+// Listen announces on the pipe name. If the process is socket activated with
+// a unix stream socket bound to the path name, the socket is used instead.
+// See ActivationIPCListeners.
 func Listen(name string) (*Listener, error) {
+	if l := activatedUnixListener(name); l != nil {
+		return &Listener{l: l}, nil
+	}
+
 	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: name, Net: "unix"})
 	if err != nil {
 		return nil, err
@@ -20,7 +26,9 @@ func (l *Listener) Accept() (*Conn, error) {
 		return nil, err
 	}
 
-	return newConn(conn), nil
+	c := newConn(conn)
+	c.policy = l.getPolicy()
+	return c, nil
 }
 
 // Dial connects to the named pipe.
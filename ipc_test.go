@@ -794,3 +794,29 @@ func newErr(err error) error {
 	_, _, line, _ := runtime.Caller(1)
 	return fmt.Errorf("(line:%v), %v", line, err)
 }
+
+// connPair returns a pair of connected Conns: the accepted one and the dialed
+// one.
+func connPair(t *testing.T, pipename string) (*Conn, *Conn) {
+	l, err := Listen(pipename)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	ch := make(chan *Conn)
+	go func() {
+		conn, err := Dial(pipename)
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+		}
+		ch <- conn
+	}()
+
+	accepted, err := l.Accept()
+	dialed := <-ch
+	if err != nil || dialed == nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	return accepted, dialed
+}
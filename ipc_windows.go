@@ -39,6 +39,7 @@ func (l *Listener) Accept() (*Conn, error) {
 
 	c.fileGW.pid = pid
 	c.socketGW.pid = pid
+	c.policy = l.getPolicy()
 
 	return c, nil
 }
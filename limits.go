@@ -0,0 +1,153 @@
+package ipc
+
+import (
+	"time"
+)
+
+// Limits restricts resources a Conn holds for the peer. A zero field means
+// unlimited.
+//
+// A handle or byte is in flight from the time it is sent until the peer
+// receives it. A peer that never drains its connection makes Send methods
+// fail with a *LimitError, or wait if Wait is set, instead of letting this
+// process run out of file descriptors or memory.
+//
+// In-flight handles and bytes are measured from the socket send queue; on
+// windows, passed handles are moved to the peer at once and only
+// MaxMessagesPerSecond is enforced.
+type Limits struct {
+	// MaxHandles is the maximum number of passed handles (files, TCP
+	// connections, listeners) in flight.
+	MaxHandles int
+	// MaxBytes is the maximum number of bytes in flight, as accounted by the
+	// system for the socket.
+	MaxBytes int
+	// MaxMessagesPerSecond is the maximum rate of messages sent by any Send
+	// method. Bursts up to one second worth of messages are allowed.
+	MaxMessagesPerSecond int
+	// Wait makes Send methods wait until the limits are satisfied; it is
+	// backpressure to the caller.
+	Wait bool
+	// Timeout bounds the waiting if Wait is set; 0 means forever.
+	Timeout time.Duration
+}
+
+// Kinds of the limits reported by LimitError.
+const (
+	LimitHandles = "handles"
+	LimitBytes   = "bytes"
+	LimitRate    = "rate"
+)
+
+// LimitError is returned from Send methods when a limit of the Conn is
+// exceeded. Limit is one of LimitHandles, LimitBytes and LimitRate.
+type LimitError struct {
+	Limit string
+}
+
+func (e *LimitError) Error() string {
+	return "limit exceeded: " + e.Limit
+}
+
+// SetLimits sets the resource limits of the connection. See Limits.
+func (c *Conn) SetLimits(l Limits) {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+
+	c.limiter = &limiter{
+		limits: l,
+		tokens: float64(l.MaxMessagesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// pollInterval is the interval to check the socket send queue while waiting.
+const pollInterval = 10 * time.Millisecond
+
+type limiter struct {
+	limits  Limits
+	handles int // handles sent while the send queue is not drained
+	tokens  float64
+	last    time.Time
+}
+
+// acquire reserves one message, and one handle if handle is true, waiting or
+// failing according to the limits.
+func (c *Conn) acquire(handle bool) error {
+	var deadline time.Time
+	for first := true; ; first = false {
+		c.lm.Lock()
+		lim := c.limiter
+		if lim == nil {
+			c.lm.Unlock()
+			return nil
+		}
+		limits := lim.limits
+		wait, err := lim.check(c, handle)
+		c.lm.Unlock()
+
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*LimitError); !ok || !limits.Wait {
+			return err
+		}
+
+		if first && limits.Timeout > 0 {
+			deadline = time.Now().Add(limits.Timeout)
+		}
+		if !deadline.IsZero() {
+			remain := time.Until(deadline)
+			if remain <= 0 {
+				return err
+			}
+			if wait > remain {
+				wait = remain
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// check reserves the resources if possible; otherwise it returns a LimitError
+// and the duration to wait before the next check. c.lm must be held.
+func (lim *limiter) check(c *Conn, handle bool) (time.Duration, error) {
+	l := &lim.limits
+
+	if l.MaxHandles > 0 || l.MaxBytes > 0 {
+		queued, err := c.queuedBytes()
+		if err != nil {
+			return 0, err
+		}
+		if queued == 0 {
+			// the peer received everything sent so far
+			lim.handles = 0
+		}
+		if l.MaxBytes > 0 && queued >= l.MaxBytes {
+			return pollInterval, &LimitError{Limit: LimitBytes}
+		}
+		if handle && l.MaxHandles > 0 && lim.handles >= l.MaxHandles {
+			return pollInterval, &LimitError{Limit: LimitHandles}
+		}
+	}
+
+	if l.MaxMessagesPerSecond > 0 {
+		now := time.Now()
+		rate := float64(l.MaxMessagesPerSecond)
+		lim.tokens += now.Sub(lim.last).Seconds() * rate
+		if lim.tokens > rate {
+			lim.tokens = rate
+		}
+		lim.last = now
+		if lim.tokens < 1 {
+			wait := time.Duration((1 - lim.tokens) / rate * float64(time.Second))
+			return wait, &LimitError{Limit: LimitRate}
+		}
+		lim.tokens--
+	}
+
+	if handle {
+		lim.handles++
+	}
+	return 0, nil
+}
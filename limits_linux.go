@@ -0,0 +1,23 @@
+package ipc
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// queuedBytes returns the bytes sent but not received by the peer yet.
+func (c *Conn) queuedBytes() (n int, err error) {
+	rawConn, err := c.conn.(*net.UnixConn).SyscallConn()
+	if err != nil {
+		return
+	}
+
+	cerr := rawConn.Control(func(fd uintptr) {
+		n, err = unix.IoctlGetInt(int(fd), unix.SIOCOUTQ)
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package ipc
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	conn, client := connPair(t, "a")
+	defer conn.Close()
+	defer client.Close()
+
+	sendFile := func() error {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.SendFile(f, nil)
+		f.Close()
+		return err
+	}
+	receiveFile := func() {
+		if _, err := client.ReceiveCommand(); err != nil {
+			t.Fatalf("ReceiveCommand error: %v", err)
+		}
+		f, _, err := client.ReceiveFile()
+		if err != nil {
+			t.Fatalf("ReceiveFile error: %v", err)
+		}
+		f.Close()
+	}
+
+	t.Run("handles in flight", func(t *testing.T) {
+		conn.SetLimits(Limits{MaxHandles: 2})
+
+		for i := 0; i < 2; i++ {
+			if err := sendFile(); err != nil {
+				t.Fatalf("SendFile error: %v", err)
+			}
+		}
+		err := sendFile()
+		if lerr, ok := err.(*LimitError); !ok || lerr.Limit != LimitHandles {
+			t.Fatalf("got error `%v` but want handles limit error", err)
+		}
+
+		receiveFile()
+		receiveFile()
+		if err := sendFile(); err != nil {
+			t.Fatalf("SendFile after drain error: %v", err)
+		}
+		receiveFile()
+	})
+
+	t.Run("wait for the peer", func(t *testing.T) {
+		conn.SetLimits(Limits{MaxHandles: 1, Wait: true, Timeout: time.Second})
+
+		if err := sendFile(); err != nil {
+			t.Fatalf("SendFile error: %v", err)
+		}
+		received := make(chan struct{})
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			receiveFile()
+			close(received)
+		}()
+		st := time.Now()
+		if err := sendFile(); err != nil {
+			t.Fatalf("SendFile error: %v", err)
+		}
+		if elapsed := time.Since(st); elapsed < 20*time.Millisecond {
+			t.Errorf("returned before the peer received: elapsed %v", elapsed)
+		}
+		<-received
+		receiveFile()
+	})
+
+	t.Run("concurrent sends", func(t *testing.T) {
+		const n, m = 4, 10
+		limits := Limits{MaxBytes: 1 << 20, MaxMessagesPerSecond: 1000, Wait: true}
+		conn.SetLimits(limits)
+
+		errc := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				for j := 0; j < m; j++ {
+					if err := conn.SendData([]byte{1}); err != nil {
+						errc <- err
+						return
+					}
+				}
+				conn.SetLimits(limits)
+				errc <- nil
+			}()
+		}
+		for i := 0; i < n*m; i++ {
+			if _, err := client.ReceiveCommand(); err != nil {
+				t.Fatalf("ReceiveCommand error: %v", err)
+			}
+			if _, err := client.ReceiveData(); err != nil {
+				t.Fatalf("ReceiveData error: %v", err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errc; err != nil {
+				t.Errorf("SendData error: %v", err)
+			}
+		}
+	})
+
+	t.Run("messages per second", func(t *testing.T) {
+		conn.SetLimits(Limits{MaxMessagesPerSecond: 2})
+
+		for i := 0; i < 2; i++ {
+			if err := conn.SendData([]byte{1}); err != nil {
+				t.Fatalf("SendData error: %v", err)
+			}
+		}
+		err := conn.SendData([]byte{1})
+		if lerr, ok := err.(*LimitError); !ok || lerr.Limit != LimitRate {
+			t.Fatalf("got error `%v` but want rate limit error", err)
+		}
+	})
+}
@@ -0,0 +1,7 @@
+package ipc
+
+// queuedBytes returns the bytes sent but not received by the peer yet. Named
+// pipes do not report it; handles are already moved to the peer on windows.
+func (c *Conn) queuedBytes() (int, error) {
+	return 0, nil
+}
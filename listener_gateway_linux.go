@@ -0,0 +1,97 @@
+package ipc
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+type listenerData struct {
+	Network  string
+	Addr     string
+	withData bool
+}
+
+func (d *listenerData) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.writeBytes([]byte(d.Network))
+	bw.writeBytes([]byte(d.Addr))
+	bw.write(d.withData)
+	return bw.err
+}
+
+func (d *listenerData) deserialize(r io.Reader) error {
+	br := &bytesReader{r, nil}
+	d.Network = string(br.readBytes())
+	d.Addr = string(br.readBytes())
+	br.read(&d.withData)
+	return br.err
+}
+
+type listenerGateway struct {
+	gateway
+}
+
+func (gw *listenerGateway) supported() bool {
+	return true
+}
+
+// send passes the socket of sc; sc is a listener or a packet connection.
+func (gw *listenerGateway) send(conn net.Conn, sc syscall.Conn, addr net.Addr, msg []byte) (err error) {
+	rawSock, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	cerr := rawSock.Control(func(fd uintptr) {
+		err = gw.sendImpl(conn,
+			int(fd),
+			&listenerData{
+				Network:  addr.Network(),
+				Addr:     addr.String(),
+				withData: len(msg) > 0,
+			},
+			msg)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+func (gw *listenerGateway) receive(conn net.Conn) (f *os.File, withData bool, err error) {
+	var ld listenerData
+	fd, err := gw.receiveImpl(conn, &ld)
+	if err != nil {
+		return
+	}
+
+	return os.NewFile(uintptr(fd), ld.Network+":"+ld.Addr), ld.withData, nil
+}
+
+func (gw *listenerGateway) receiveListener(conn net.Conn) (net.Listener, bool, error) {
+	f, withData, err := gw.receive(conn)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	return l, withData, err
+}
+
+func (gw *listenerGateway) receivePacketConn(conn net.Conn) (net.PacketConn, bool, error) {
+	f, withData, err := gw.receive(conn)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	pc, err := net.FilePacketConn(f)
+	return pc, withData, err
+}
+
+func newListenerGateway() *listenerGateway {
+	return &listenerGateway{}
+}
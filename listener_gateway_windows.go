@@ -0,0 +1,32 @@
+package ipc
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenerGateway is not supported on windows; go can not make a net.Listener
+// from a duplicated socket.
+type listenerGateway struct {
+	gateway
+}
+
+func (gw *listenerGateway) supported() bool {
+	return false
+}
+
+func (gw *listenerGateway) send(conn net.Conn, sc syscall.Conn, addr net.Addr, msg []byte) error {
+	return ErrNotSupported
+}
+
+func (gw *listenerGateway) receiveListener(conn net.Conn) (net.Listener, bool, error) {
+	return nil, false, ErrNotSupported
+}
+
+func (gw *listenerGateway) receivePacketConn(conn net.Conn) (net.PacketConn, bool, error) {
+	return nil, false, ErrNotSupported
+}
+
+func newListenerGateway() *listenerGateway {
+	return &listenerGateway{}
+}
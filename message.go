@@ -0,0 +1,132 @@
+package ipc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sendMessage sends a serialized message as data. The peer receives it with
+// receiveMessage.
+func (c *Conn) sendMessage(s serializer) error {
+	var b bytes.Buffer
+	if err := s.serialize(&b); err != nil {
+		return err
+	}
+	return c.SendData(b.Bytes())
+}
+
+// receiveMessage receives data sent by sendMessage. It must be called after
+// ReceiveCommand returned DataCommand.
+func (c *Conn) receiveMessage(d deserializer) error {
+	data, err := c.ReceiveData()
+	if err != nil {
+		return err
+	}
+	return d.deserialize(bytes.NewReader(data))
+}
+
+// receiveRequest receives a message sent by sendMessage as a request of a
+// server named name. It returns io.EOF when the peer closed the connection.
+func (c *Conn) receiveRequest(name string, req deserializer) error {
+	cmd, err := c.ReceiveCommand()
+	if err != nil {
+		return err
+	}
+	if cmd != DataCommand {
+		return fmt.Errorf("%s: unexpected command %v", name, cmd)
+	}
+	return c.receiveMessage(req)
+}
+
+// serveConns accepts connections on l and serves each of them with serve in a
+// new goroutine. It returns when Accept fails, e.g. l was closed.
+func serveConns(l *Listener, serve func(c *Conn) error) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			serve(c)
+		}()
+	}
+}
+
+// sendError sends err as a message. The peer receives it with receiveError.
+func (c *Conn) sendError(err error) error {
+	return c.sendMessage(&errorMessage{Code: errorCode(err), Message: err.Error()})
+}
+
+// receiveError receives an error sent by sendError. Well known errors are
+// restored so that the receiver can examine them with errors.Is.
+func (c *Conn) receiveError() error {
+	var m errorMessage
+	if err := c.receiveMessage(&m); err != nil {
+		return err
+	}
+	return m.err()
+}
+
+const (
+	errOther = iota
+	errNotPermitted
+	errNotExist
+	errExist
+	errPermission
+	errFDStoreFull
+)
+
+func errorCode(err error) int32 {
+	switch {
+	case err == ErrNotPermitted:
+		return errNotPermitted
+	case os.IsNotExist(err):
+		return errNotExist
+	case os.IsExist(err):
+		return errExist
+	case os.IsPermission(err):
+		return errPermission
+	case err == ErrFDStoreFull:
+		return errFDStoreFull
+	}
+	return errOther
+}
+
+type errorMessage struct {
+	Code    int32
+	Message string
+}
+
+func (m *errorMessage) err() error {
+	switch m.Code {
+	case errNotPermitted:
+		return ErrNotPermitted
+	case errNotExist:
+		return os.ErrNotExist
+	case errExist:
+		return os.ErrExist
+	case errPermission:
+		return os.ErrPermission
+	case errFDStoreFull:
+		return ErrFDStoreFull
+	}
+	return errors.New(m.Message)
+}
+
+func (m *errorMessage) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(m.Code)
+	bw.writeBytes([]byte(m.Message))
+	return bw.err
+}
+
+func (m *errorMessage) deserialize(rd io.Reader) error {
+	br := &bytesReader{rd, nil}
+	br.read(&m.Code)
+	m.Message = string(br.readBytes())
+	return br.err
+}
@@ -0,0 +1,301 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Migration is the sending side of a migration session, which passes live
+// connections together with their application state to a successor process,
+// e.g. WebSocket connections on a restart.
+//
+// The connections are kept open by the sender until the successor commits
+// the session, so that the sender can keep serving them if the successor
+// aborts or dies halfway:
+//
+//	m, _ := conn.BeginMigration()
+//	for _, s := range sessions {
+//		s.Pause()
+//		m.Send(s.Conn, nil, s.State())
+//	}
+//	if err := m.Commit(ctx); err != nil {
+//		// rolled back; resume the sessions
+//	}
+//
+// The session uses the IPC connection exclusively; nothing else may be sent
+// or received on it until Commit or Rollback returns.
+type Migration struct {
+	c     *Conn
+	conns []net.Conn
+	done  bool
+}
+
+// BeginMigration starts a migration session to the peer, which receives it
+// with ReceiveMigration.
+func (c *Conn) BeginMigration() (*Migration, error) {
+	if err := c.sendMessage(&migrationMessage{Kind: migrationBegin}); err != nil {
+		return nil, err
+	}
+	return &Migration{c: c}, nil
+}
+
+// Send passes conn and its state to the successor. conn must not be read from
+// or written to after Send; it is closed by Commit. buffered is data already
+// read from conn but not consumed; see Conn.HandBack for conn and buffered.
+//
+// If Send fails, the session is broken; call Rollback.
+func (m *Migration) Send(conn net.Conn, buffered, state []byte) error {
+	if m.done {
+		return errMigrationDone
+	}
+
+	sock, buffered, err := unwrapConn(conn, buffered)
+	if err != nil {
+		return err
+	}
+	if err := m.c.sendSocket(sock, buffered, state); err != nil {
+		return err
+	}
+	m.conns = append(m.conns, conn)
+	return nil
+}
+
+// Commit ends the sending and waits until the successor commits the session;
+// then it confirms the commit to the successor and closes the connections
+// passed. If the successor aborts the session, ErrMigrationAborted is
+// returned; if it dies, or ctx is done before its reply, the error is
+// returned. In these cases the session is rolled back, i.e. the connections
+// are left open for the sender; the successor does not serve them since it
+// waits for the confirmation.
+//
+// The IPC connection is closed if ctx is done, since the pending reply can not
+// be skipped.
+func (m *Migration) Commit(ctx context.Context) error {
+	if m.done {
+		return errMigrationDone
+	}
+	m.done = true
+
+	end := &migrationMessage{Kind: migrationEnd, Count: uint32(len(m.conns))}
+	if err := m.c.sendMessage(end); err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- receiveMigrationReply(m.c, migrationCommit) }()
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		m.c.Close()
+		return ctx.Err()
+	}
+
+	if err := m.c.sendMessage(&migrationMessage{Kind: migrationConfirm}); err != nil {
+		// the successor may not have the confirmation; make sure it gives up
+		m.c.Close()
+		return err
+	}
+
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// Rollback aborts the session; the successor closes the connections received.
+func (m *Migration) Rollback() error {
+	if m.done {
+		return nil
+	}
+	m.done = true
+	return m.c.sendMessage(&migrationMessage{Kind: migrationAbort})
+}
+
+// receiveMigrationReply receives the reply of the other side; it returns nil
+// if it is want.
+func receiveMigrationReply(c *Conn, want uint8) error {
+	cmd, err := c.ReceiveCommand()
+	if err == io.EOF {
+		return errors.New("migration peer exited before commit")
+	}
+	if err != nil {
+		return err
+	}
+	if cmd != DataCommand {
+		return errors.New("unexpected command " + cmd.String())
+	}
+
+	var m migrationMessage
+	if err := c.receiveMessage(&m); err != nil {
+		return err
+	}
+	switch m.Kind {
+	case want:
+		return nil
+	case migrationAbort:
+		return ErrMigrationAborted
+	}
+	return fmt.Errorf("unexpected migration message %d", m.Kind)
+}
+
+// MigratedConn is a connection received in a migration session.
+type MigratedConn struct {
+	TCPConn
+
+	// State is the application state passed with the connection.
+	State []byte
+}
+
+// MigrationReceiver is the receiving side of a migration session. See
+// Migration.
+type MigrationReceiver struct {
+	c     *Conn
+	conns []*MigratedConn
+	done  bool
+}
+
+// ReceiveMigration receives a migration session started by BeginMigration. It
+// returns after all the connections are received, when the sender calls
+// Commit. The receiver rebuilds the connections from Conns and then calls
+// Commit, or Abort to hand them back to the sender.
+//
+// If the sender rolls back the session, ErrMigrationAborted is returned; the
+// connections received are closed in case of any error.
+func (c *Conn) ReceiveMigration() (*MigrationReceiver, error) {
+	r := &MigrationReceiver{c: c}
+	if err := r.receive(); err != nil {
+		r.closeConns()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Conns returns the connections received in the order they were sent. They
+// must not be used until Commit succeeds.
+func (r *MigrationReceiver) Conns() []*MigratedConn {
+	return r.conns
+}
+
+// Commit tells the sender that the connections are taken over, and waits for
+// the confirmation of the sender. If the sender has rolled back, e.g. its ctx
+// of Migration.Commit is done, or dies, the connections received are closed
+// and the error is returned.
+func (r *MigrationReceiver) Commit() error {
+	if r.done {
+		return errMigrationDone
+	}
+	r.done = true
+
+	err := r.c.sendMessage(&migrationMessage{Kind: migrationCommit})
+	if err == nil {
+		err = receiveMigrationReply(r.c, migrationConfirm)
+	}
+	if err != nil {
+		r.closeConns()
+		return err
+	}
+	return nil
+}
+
+// Abort closes the connections received and tells the sender to keep serving
+// them.
+func (r *MigrationReceiver) Abort() error {
+	if r.done {
+		return errMigrationDone
+	}
+	r.done = true
+	r.closeConns()
+	return r.c.sendMessage(&migrationMessage{Kind: migrationAbort})
+}
+
+func (r *MigrationReceiver) receive() error {
+	c := r.c
+	begun := false
+	for {
+		cmd, err := c.ReceiveCommand()
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case DataCommand:
+			var m migrationMessage
+			if err := c.receiveMessage(&m); err != nil {
+				return err
+			}
+			switch {
+			case m.Kind == migrationBegin && !begun:
+				begun = true
+			case m.Kind == migrationEnd && begun:
+				if int(m.Count) != len(r.conns) {
+					return fmt.Errorf("received %d connections but %d sent", len(r.conns), m.Count)
+				}
+				return nil
+			case m.Kind == migrationAbort && begun:
+				return ErrMigrationAborted
+			default:
+				return fmt.Errorf("unexpected migration message %d", m.Kind)
+			}
+
+		case TCPConnCommand:
+			if !begun {
+				return errors.New("connection before migration begins")
+			}
+			conn, withData, err := c.ReceiveTCPConn()
+			if err != nil {
+				return err
+			}
+			var state []byte
+			if withData {
+				if state, err = c.ReceiveData(); err != nil {
+					conn.Close()
+					return err
+				}
+			}
+			setHandoffMsg(conn, state)
+			r.conns = append(r.conns, &MigratedConn{conn, state})
+
+		default:
+			return errors.New("unexpected command " + cmd.String())
+		}
+	}
+}
+
+func (r *MigrationReceiver) closeConns() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+const (
+	migrationBegin = iota + 1
+	migrationEnd
+	migrationCommit
+	migrationAbort
+	migrationConfirm
+)
+
+type migrationMessage struct {
+	Kind  uint8
+	Count uint32
+}
+
+func (m *migrationMessage) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(m.Kind)
+	bw.write(m.Count)
+	return bw.err
+}
+
+func (m *migrationMessage) deserialize(r io.Reader) error {
+	br := &bytesReader{r, nil}
+	br.read(&m.Kind)
+	br.read(&m.Count)
+	return br.err
+}
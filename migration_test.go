@@ -0,0 +1,245 @@
+package ipc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMigration(t *testing.T) {
+	echo := func(t *testing.T, conn net.Conn, client net.Conn) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+		if string(b) != "ping" {
+			t.Errorf("got %q but want %q", b, "ping")
+		}
+	}
+
+	// send begins a session and passes two connections
+	send := func(t *testing.T, c *Conn) (*Migration, []net.Conn, []net.Conn) {
+		t.Helper()
+		m, err := c.BeginMigration()
+		if err != nil {
+			t.Fatalf("BeginMigration error: %v", err)
+		}
+		var conns, clients []net.Conn
+		for _, state := range []string{"s0", "s1"} {
+			conn, client := tcpPair(t)
+			if err := m.Send(conn, nil, []byte(state)); err != nil {
+				t.Fatalf("Send error: %v", err)
+			}
+			conns = append(conns, conn)
+			clients = append(clients, client)
+		}
+		return m, conns, clients
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		old, successor := connPair(t, "a")
+		defer old.Close()
+		defer successor.Close()
+
+		m, _, clients := send(t, old)
+		defer clients[0].Close()
+		defer clients[1].Close()
+		// the buffered data precedes the data unread in the socket
+		conn, client := tcpPair(t)
+		defer client.Close()
+		if err := m.Send(conn, []byte("buf:"), nil); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+
+		done := make(chan error)
+		go func() { done <- m.Commit(context.Background()) }()
+
+		r, err := successor.ReceiveMigration()
+		if err != nil {
+			t.Fatalf("ReceiveMigration error: %v", err)
+		}
+		if err := r.Commit(); err != nil {
+			t.Fatalf("Commit error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("Commit of sender error: %v", err)
+		}
+
+		conns := r.Conns()
+		if len(conns) != 3 {
+			t.Fatalf("got %d connections but want 3", len(conns))
+		}
+		for i, state := range []string{"s0", "s1"} {
+			if string(conns[i].State) != state {
+				t.Errorf("got state %q but want %q", conns[i].State, state)
+			}
+			if info, ok := HandoffInfo(conns[i]); !ok || string(info.Msg) != state {
+				t.Errorf("got handoff info %v, %v", info, ok)
+			}
+			echo(t, conns[i], clients[i])
+			conns[i].Close()
+		}
+		if conns[2].State != nil {
+			t.Errorf("got state %q but want nil", conns[2].State)
+		}
+		client.Write([]byte("data"))
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(conns[2], b); err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+		if !bytes.Equal(b, []byte("buf:data")) {
+			t.Errorf("got %q but want %q", b, "buf:data")
+		}
+		conns[2].Close()
+	})
+
+	t.Run("successor aborts", func(t *testing.T) {
+		old, successor := connPair(t, "a")
+		defer old.Close()
+		defer successor.Close()
+
+		m, conns, clients := send(t, old)
+		done := make(chan error)
+		go func() { done <- m.Commit(context.Background()) }()
+
+		r, err := successor.ReceiveMigration()
+		if err != nil {
+			t.Fatalf("ReceiveMigration error: %v", err)
+		}
+		if err := r.Abort(); err != nil {
+			t.Fatalf("Abort error: %v", err)
+		}
+		if err := <-done; err != ErrMigrationAborted {
+			t.Fatalf("got error `%v` but want `%v`", err, ErrMigrationAborted)
+		}
+
+		// rolled back; the sender keeps serving
+		for i := range conns {
+			echo(t, conns[i], clients[i])
+			conns[i].Close()
+			clients[i].Close()
+		}
+	})
+
+	t.Run("successor dies", func(t *testing.T) {
+		old, successor := connPair(t, "a")
+		defer old.Close()
+
+		m, conns, clients := send(t, old)
+		successor.Close()
+		if err := m.Commit(context.Background()); err == nil {
+			t.Fatal("Commit succeeded")
+		}
+		for i := range conns {
+			echo(t, conns[i], clients[i])
+			conns[i].Close()
+			clients[i].Close()
+		}
+	})
+
+	t.Run("sender times out before commit", func(t *testing.T) {
+		old, successor := connPair(t, "a")
+		defer old.Close()
+		defer successor.Close()
+
+		m, conns, clients := send(t, old)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := m.Commit(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("got error `%v` but want `%v`", err, context.DeadlineExceeded)
+		}
+
+		// the successor commits too late; it must not serve the connections
+		r, err := successor.ReceiveMigration()
+		if err != nil {
+			t.Fatalf("ReceiveMigration error: %v", err)
+		}
+		if err := r.Commit(); err == nil {
+			t.Fatal("Commit succeeded")
+		}
+		for _, conn := range r.Conns() {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := conn.Read(make([]byte, 1)); err == nil || err == ErrTimeout {
+				t.Errorf("connection of the successor is not closed")
+			}
+		}
+
+		for i := range conns {
+			echo(t, conns[i], clients[i])
+			conns[i].Close()
+			clients[i].Close()
+		}
+	})
+
+	t.Run("sender rolls back", func(t *testing.T) {
+		old, successor := connPair(t, "a")
+		defer old.Close()
+		defer successor.Close()
+
+		m, conns, clients := send(t, old)
+		if err := m.Rollback(); err != nil {
+			t.Fatalf("Rollback error: %v", err)
+		}
+		if _, err := successor.ReceiveMigration(); err != ErrMigrationAborted {
+			t.Fatalf("got error `%v` but want `%v`", err, ErrMigrationAborted)
+		}
+		for i := range conns {
+			echo(t, conns[i], clients[i])
+			conns[i].Close()
+			clients[i].Close()
+		}
+	})
+	t.Run("peeked data kept on rollback", func(t *testing.T) {
+		old, successor := connPair(t, "a")
+		defer old.Close()
+		defer successor.Close()
+
+		// a connection received with peeked data
+		sender, receiver := connPair(t, "b")
+		defer sender.Close()
+		defer receiver.Close()
+		conn, client := tcpPair(t)
+		defer client.Close()
+		if err := sender.SendTCPConn(conn, []byte("pi"), nil); err != nil {
+			t.Fatalf("SendTCPConn error: %v", err)
+		}
+		if _, err := receiver.ReceiveCommand(); err != nil {
+			t.Fatalf("ReceiveCommand error: %v", err)
+		}
+		received, _, err := receiver.ReceiveTCPConn()
+		if err != nil {
+			t.Fatalf("ReceiveTCPConn error: %v", err)
+		}
+		defer received.Close()
+
+		m, err := old.BeginMigration()
+		if err != nil {
+			t.Fatalf("BeginMigration error: %v", err)
+		}
+		if err := m.Send(received, nil, nil); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+		if err := m.Rollback(); err != nil {
+			t.Fatalf("Rollback error: %v", err)
+		}
+
+		client.Write([]byte("ng"))
+		received.SetDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(received, b); err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+		if string(b) != "ping" {
+			t.Errorf("got %q but want %q", b, "ping")
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package ipc
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Notify sends state to the service manager with the sd_notify protocol,
+// e.g. "READY=1" or "STOPPING=1". It returns false if NOTIFY_SOCKET is not
+// set, i.e. the process is not run by a service manager.
+func Notify(state string) (bool, error) {
+	return sdNotify(state, nil)
+}
+
+// NotifyFDStore stores fds into the file descriptor store of the service
+// manager under name, with FDSTORE=1 and FDNAME=name. After a restart of the
+// service, they are passed back by socket activation; see ActivationFiles.
+// The service needs FileDescriptorStoreMax= set.
+//
+// fds are e.g. listeners, TCPConns received from a peer or *os.Files; they
+// are left open.
+func NotifyFDStore(name string, fds ...syscall.Conn) (bool, error) {
+	if err := checkFDName(name); err != nil {
+		return false, err
+	}
+	return sdNotify("FDSTORE=1\nFDNAME="+name, fds)
+}
+
+// NotifyFDStoreRemove removes the descriptors stored under name from the file
+// descriptor store.
+func NotifyFDStoreRemove(name string) (bool, error) {
+	if err := checkFDName(name); err != nil {
+		return false, err
+	}
+	return sdNotify("FDSTOREREMOVE=1\nFDNAME="+name, nil)
+}
+
+func checkFDName(name string) error {
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, ":\n") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package ipc
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func sdNotify(state string, scs []syscall.Conn) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	fds := make([]int, 0, len(scs))
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	for _, sc := range scs {
+		fd, err := dupFd(sc)
+		if err != nil {
+			return false, err
+		}
+		fds = append(fds, fd)
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := sendDatagram(conn, []byte(state), fds); err != nil {
+		return false, err
+	}
+	return true, nil
+}
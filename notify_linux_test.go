@@ -0,0 +1,118 @@
+package ipc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if ok, err := Notify("READY=1"); ok || err != nil {
+		t.Errorf("got %v, error `%v` without NOTIFY_SOCKET", ok, err)
+	}
+
+	dir, err := ioutil.TempDir("", "go-ipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+
+	// a fake service manager
+	manager, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	receive := func() (string, []int) {
+		t.Helper()
+		b := make([]byte, 256)
+		oob := make([]byte, unix.CmsgSpace(4*4))
+		n, oobn, _, _, err := manager.ReadMsgUnix(b, oob)
+		if err != nil {
+			t.Fatalf("ReadMsgUnix error: %v", err)
+		}
+		var fds []int
+		if oobn > 0 {
+			msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fds, err = unix.ParseUnixRights(&msgs[0]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return string(b[:n]), fds
+	}
+
+	t.Run("state", func(t *testing.T) {
+		if ok, err := Notify("READY=1"); !ok || err != nil {
+			t.Fatalf("got %v, error `%v`", ok, err)
+		}
+		if state, fds := receive(); state != "READY=1" || len(fds) != 0 {
+			t.Errorf("got %q with %d fds", state, len(fds))
+		}
+	})
+
+	t.Run("fd store", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		conn, client := tcpPair(t)
+		defer conn.Close()
+		defer client.Close()
+
+		if ok, err := NotifyFDStore("web", l.(*net.TCPListener), conn); !ok || err != nil {
+			t.Fatalf("got %v, error `%v`", ok, err)
+		}
+		state, fds := receive()
+		for _, fd := range fds {
+			defer unix.Close(fd)
+		}
+		if state != "FDSTORE=1\nFDNAME=web" {
+			t.Errorf("got %q", state)
+		}
+		if len(fds) != 2 {
+			t.Fatalf("got %d fds but want 2", len(fds))
+		}
+		for i, want := range []net.Addr{l.Addr(), conn.LocalAddr()} {
+			sa, err := unix.Getsockname(fds[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			in4 := sa.(*unix.SockaddrInet4)
+			if got := (&net.TCPAddr{IP: in4.Addr[:], Port: in4.Port}).String(); got != want.String() {
+				t.Errorf("got address %s but want %s", got, want)
+			}
+		}
+
+		// the stored listener is still served by the process
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial error: %v", err)
+		}
+		c.Close()
+	})
+
+	t.Run("fd store remove", func(t *testing.T) {
+		if ok, err := NotifyFDStoreRemove("web"); !ok || err != nil {
+			t.Fatalf("got %v, error `%v`", ok, err)
+		}
+		if state, _ := receive(); state != "FDSTOREREMOVE=1\nFDNAME=web" {
+			t.Errorf("got %q", state)
+		}
+		if _, err := NotifyFDStore("a:b"); err == nil {
+			t.Error("invalid name accepted")
+		}
+	})
+}
@@ -0,0 +1,7 @@
+package ipc
+
+import "syscall"
+
+func sdNotify(state string, scs []syscall.Conn) (bool, error) {
+	return false, nil
+}
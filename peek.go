@@ -0,0 +1,46 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errPeekTooLarge = errors.New("peeked data too large")
+
+// peekConn reads conn until complete reports the data read so far is enough.
+// It reads at most max bytes and fails with errPeekTooLarge if they are not
+// enough. The read deadline of conn is set to timeout and cleared on return.
+func peekConn(conn net.Conn, max int, timeout time.Duration, complete func(b []byte) bool) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	size := 1024
+	if size > max {
+		size = max
+	}
+	peeked := make([]byte, 0, size)
+	for {
+		if len(peeked) == cap(peeked) {
+			if len(peeked) >= max {
+				return peeked, errPeekTooLarge
+			}
+			size = 2 * cap(peeked)
+			if size > max {
+				size = max
+			}
+			grown := make([]byte, len(peeked), size)
+			copy(grown, peeked)
+			peeked = grown
+		}
+
+		n, err := conn.Read(peeked[len(peeked):cap(peeked)])
+		peeked = peeked[:len(peeked)+n]
+		if complete(peeked) {
+			return peeked, nil
+		}
+		if err != nil {
+			return peeked, err
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package ipc
+
+// Peer describes the process on the other side of a Conn.
+//
+// UID and GID are -1 if the platform does not provide them. Path is empty if
+// the executable path of the peer could not be resolved.
+type Peer struct {
+	PID  int
+	UID  int
+	GID  int
+	Path string
+}
+
+// Peer returns the process information of the peer. The result is cached; it
+// is resolved once for the connection.
+func (c *Conn) Peer() (*Peer, error) {
+	c.pm.Lock()
+	defer c.pm.Unlock()
+
+	if c.peer != nil {
+		return c.peer, nil
+	}
+
+	p, err := c.lookupPeer()
+	if err != nil {
+		return nil, err
+	}
+	c.peer = p
+	return p, nil
+}
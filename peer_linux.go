@@ -0,0 +1,39 @@
+package ipc
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+func (c *Conn) lookupPeer() (p *Peer, err error) {
+	rawConn, err := c.conn.(*net.UnixConn).SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred *unix.Ucred
+	cerr := rawConn.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return
+	}
+
+	// The executable may be unreadable (e.g. owned by other user); Path is
+	// left empty in that case, and only the deny rules with Path match the
+	// peer.
+	path, _ := os.Readlink("/proc/" + strconv.Itoa(int(cred.Pid)) + "/exe")
+
+	return &Peer{
+		PID:  int(cred.Pid),
+		UID:  int(cred.Uid),
+		GID:  int(cred.Gid),
+		Path: path,
+	}, nil
+}
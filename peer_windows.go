@@ -0,0 +1,10 @@
+package ipc
+
+func (c *Conn) lookupPeer() (*Peer, error) {
+	// The pid is exchanged at Accept and Dial; there is no uid/gid on windows.
+	return &Peer{
+		PID: int(c.socketGW.pid),
+		UID: -1,
+		GID: -1,
+	}, nil
+}
@@ -0,0 +1,279 @@
+package ipc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Access is a direction in which a Command is transferred, seen from the peer.
+type Access int
+
+// Kinds of Access.
+const (
+	// AccessSend is the peer sending the command to this process.
+	AccessSend Access = 1 << iota
+	// AccessReceive is the peer receiving the command from this process.
+	AccessReceive
+)
+
+// ID returns a pointer to id, to set the matchers of a Rule.
+func ID(id int) *int {
+	return &id
+}
+
+// Rule is an entry of a Policy.
+//
+// A rule matches a peer when all of UID, GID, PID and Path match; a nil ID and
+// an empty Path match anything, so that the zero value matches every peer.
+// Commands matches any command if it is empty.
+//
+// If the executable of the peer could not be resolved, a rule with Path
+// matches the peer only if it denies; the peer is never allowed by its path.
+type Rule struct {
+	Allow    bool
+	Access   Access
+	Commands []Command
+	UID      *int
+	GID      *int
+	PID      *int
+	Path     string
+}
+
+func (r *Rule) match(p *Peer, a Access, cmd Command) bool {
+	if r.Access&a == 0 {
+		return false
+	}
+	if r.UID != nil && *r.UID != p.UID {
+		return false
+	}
+	if r.GID != nil && *r.GID != p.GID {
+		return false
+	}
+	if r.PID != nil && *r.PID != p.PID {
+		return false
+	}
+	if r.Path != "" && p.Path == "" && r.Allow {
+		return false
+	}
+	if r.Path != "" && p.Path != "" && r.Path != p.Path {
+		return false
+	}
+	if len(r.Commands) == 0 {
+		return true
+	}
+	for _, c := range r.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy decides which peer may send or receive which Command.
+//
+// Rules are evaluated in the order they were added; the first matching rule
+// decides. If no rule matches, DefaultAllow decides.
+//
+// A Policy must not be modified while it is used by a Listener or Conn.
+type Policy struct {
+	DefaultAllow bool
+	rules        []Rule
+}
+
+// NewPolicy creates an empty Policy.
+func NewPolicy(defaultAllow bool) *Policy {
+	return &Policy{DefaultAllow: defaultAllow}
+}
+
+// Add appends a rule to the policy.
+func (p *Policy) Add(r Rule) {
+	p.rules = append(p.rules, r)
+}
+
+// Allowed reports whether the peer is permitted to transfer cmd in the
+// direction a.
+func (p *Policy) Allowed(peer *Peer, a Access, cmd Command) bool {
+	for i := range p.rules {
+		if p.rules[i].match(peer, a, cmd) {
+			return p.rules[i].Allow
+		}
+	}
+	return p.DefaultAllow
+}
+
+// LoadPolicy reads a policy from the named file. See ParsePolicy for the
+// format.
+func LoadPolicy(name string) (*Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParsePolicy(f)
+}
+
+// ParsePolicy reads a policy from r.
+//
+// The policy is written one rule per line. Empty lines and lines beginning
+// with '#' are ignored.
+//
+//	default allow|deny
+//	allow|deny ACCESS COMMANDS [uid=N] [gid=N] [pid=N] [path=EXE]
+//
+// ACCESS is "send", "receive" or "send,receive", and COMMANDS is a comma
+// separated list of command names ("data", "file", "tcpconn", ...). "*"
+// matches everything in both fields. For example, the following policy lets
+// a monitoring tool send data but never receive files or TCP connections:
+//
+//	default allow
+//	deny receive file,tcpconn path=/usr/local/bin/monitor
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	p := NewPolicy(false)
+
+	s := bufio.NewScanner(r)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if err := p.parseLine(strings.Fields(line)); err != nil {
+			return nil, fmt.Errorf("policy: line %d: %v", lineno, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Policy) parseLine(fields []string) error {
+	if fields[0] == "default" {
+		if len(fields) != 2 {
+			return fmt.Errorf("default takes one argument")
+		}
+		allow, err := parseAction(fields[1])
+		if err != nil {
+			return err
+		}
+		p.DefaultAllow = allow
+		return nil
+	}
+
+	if len(fields) < 3 {
+		return fmt.Errorf("too few fields")
+	}
+
+	var r Rule
+	var err error
+	if r.Allow, err = parseAction(fields[0]); err != nil {
+		return err
+	}
+	if r.Access, err = parseAccess(fields[1]); err != nil {
+		return err
+	}
+	if r.Commands, err = parseCommands(fields[2]); err != nil {
+		return err
+	}
+
+	for _, f := range fields[3:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad matcher %q", f)
+		}
+		switch kv[0] {
+		case "uid":
+			r.UID, err = parseID(kv[1])
+		case "gid":
+			r.GID, err = parseID(kv[1])
+		case "pid":
+			r.PID, err = parseID(kv[1])
+		case "path":
+			r.Path = kv[1]
+		default:
+			return fmt.Errorf("unknown matcher %q", kv[0])
+		}
+		if err != nil {
+			return fmt.Errorf("bad matcher %q: %v", f, err)
+		}
+	}
+
+	p.Add(r)
+	return nil
+}
+
+func parseID(s string) (*int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func parseAction(s string) (bool, error) {
+	switch s {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown action %q", s)
+}
+
+func parseAccess(s string) (a Access, err error) {
+	if s == "*" {
+		return AccessSend | AccessReceive, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		switch v {
+		case "send":
+			a |= AccessSend
+		case "receive":
+			a |= AccessReceive
+		default:
+			return 0, fmt.Errorf("unknown access %q", v)
+		}
+	}
+	return
+}
+
+func parseCommands(s string) ([]Command, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	var cmds []Command
+	for _, v := range strings.Split(s, ",") {
+		cmd, ok := commandByName(v)
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q", v)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// checkAccess returns ErrNotPermitted if the policy of c denies the peer to
+// transfer cmd in the direction a.
+func (c *Conn) checkAccess(a Access, cmd Command) error {
+	policy := c.getPolicy()
+	if policy == nil {
+		return nil
+	}
+
+	p, err := c.Peer()
+	if err != nil {
+		return err
+	}
+	if !policy.Allowed(p, a, cmd) {
+		return ErrNotPermitted
+	}
+	return nil
+}
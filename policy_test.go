@@ -0,0 +1,200 @@
+package ipc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	const src = `
+# monitoring tool
+default allow
+deny receive file,tcpconn path=/usr/local/bin/monitor
+allow send,receive * uid=0
+deny * data gid=10 pid=20
+`
+	p, err := ParsePolicy(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("ParsePolicy error: %v", err)
+	}
+
+	monitor := &Peer{PID: 1, UID: 1000, GID: 1000, Path: "/usr/local/bin/monitor"}
+	root := &Peer{PID: 1, UID: 0, GID: 0, Path: "/usr/local/bin/monitor"}
+	other := &Peer{PID: 20, UID: 1000, GID: 10, Path: "/bin/other"}
+	unresolved := &Peer{PID: 30, UID: 1001, GID: 1001}
+
+	var tests = []struct {
+		peer *Peer
+		a    Access
+		cmd  Command
+		want bool
+	}{
+		{monitor, AccessSend, DataCommand, true},
+		{monitor, AccessReceive, DataCommand, true},
+		{monitor, AccessReceive, FileCommand, false},
+		{monitor, AccessReceive, TCPConnCommand, false},
+		{monitor, AccessSend, TCPConnCommand, true},
+		{root, AccessReceive, FileCommand, false},
+		{other, AccessSend, DataCommand, false},
+		{other, AccessReceive, FileCommand, true},
+		{unresolved, AccessReceive, TCPConnCommand, false},
+		{unresolved, AccessReceive, DataCommand, true},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%v/%v/%v", tt.peer.Path, tt.a, tt.cmd)
+		t.Run(name, func(t *testing.T) {
+			if got := p.Allowed(tt.peer, tt.a, tt.cmd); got != tt.want {
+				t.Errorf("got %v but want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unresolved path is not allowed", func(t *testing.T) {
+		p := NewPolicy(false)
+		p.Add(Rule{Allow: true, Access: AccessReceive, Path: "/usr/local/bin/monitor"})
+		if p.Allowed(unresolved, AccessReceive, DataCommand) {
+			t.Error("allowed by path")
+		}
+	})
+
+	t.Run("zero rule matches any peer", func(t *testing.T) {
+		p := NewPolicy(true)
+		p.Add(Rule{Access: AccessReceive, Commands: []Command{TCPConnCommand}})
+		if p.Allowed(root, AccessReceive, TCPConnCommand) {
+			t.Error("allowed by default")
+		}
+	})
+
+	t.Run("syntax errors", func(t *testing.T) {
+		for _, src := range []string{
+			"default maybe",
+			"allow send",
+			"allow write data",
+			"allow send unknown",
+			"allow send data uid=x",
+			"allow send data user=0",
+		} {
+			if _, err := ParsePolicy(strings.NewReader(src)); err == nil {
+				t.Errorf("%q: expected error but returned nil", src)
+			}
+		}
+	})
+}
+
+func TestConnPolicy(t *testing.T) {
+	p := NewPolicy(true)
+	p.Add(Rule{
+		Allow:    false,
+		Access:   AccessReceive,
+		Commands: []Command{FileCommand},
+		PID:      ID(os.Getpid()),
+	})
+	p.Add(Rule{
+		Allow:    false,
+		Access:   AccessSend,
+		Commands: []Command{TCPConnCommand},
+	})
+
+	pipename := "a"
+	l, err := Listen(pipename)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	l.SetPolicy(p)
+
+	ch := make(chan *Conn)
+	go func() {
+		conn, err := Dial(pipename)
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+		}
+		ch <- conn
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	client := <-ch
+	if client == nil {
+		t.FailNow()
+	}
+	defer client.Close()
+
+	peer, err := conn.Peer()
+	if err != nil {
+		t.Fatalf("Peer error: %v", err)
+	}
+	if got, want := peer.PID, os.Getpid(); got != want {
+		t.Errorf("got pid %v but want %v", got, want)
+	}
+
+	t.Run("SendFile is denied", func(t *testing.T) {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if got, want := conn.SendFile(f, nil), ErrNotPermitted; got != want {
+			t.Errorf("got error `%v` but want `%v`", got, want)
+		}
+	})
+
+	t.Run("SendData is allowed", func(t *testing.T) {
+		if err := conn.SendData([]byte("data")); err != nil {
+			t.Fatalf("SendData error: %v", err)
+		}
+		cmd, err := client.ReceiveCommand()
+		if err != nil {
+			t.Fatalf("ReceiveCommand error: %v", err)
+		}
+		if got, want := cmd, DataCommand; got != want {
+			t.Errorf("got command %v but want %v", got, want)
+		}
+		if _, err := client.ReceiveData(); err != nil {
+			t.Errorf("ReceiveData error: %v", err)
+		}
+	})
+
+	t.Run("concurrent sends", func(t *testing.T) {
+		const n = 4
+		client.SetPolicy(p)
+		errc := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				client.SetPolicy(p)
+				errc <- client.SendData([]byte("data"))
+			}()
+		}
+		for i := 0; i < n; i++ {
+			if _, err := conn.ReceiveCommand(); err != nil {
+				t.Fatalf("ReceiveCommand error: %v", err)
+			}
+			if _, err := conn.ReceiveData(); err != nil {
+				t.Fatalf("ReceiveData error: %v", err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			if err := <-errc; err != nil {
+				t.Errorf("SendData error: %v", err)
+			}
+		}
+	})
+
+	t.Run("peer sending denied command is dropped", func(t *testing.T) {
+		if _, err := client.Write([]byte{byte(TCPConnCommand)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ReceiveCommand(); err != ErrNotPermitted {
+			t.Errorf("got error `%v` but want `%v`", err, ErrNotPermitted)
+		}
+		if _, err := conn.ReceiveCommand(); err == nil {
+			t.Errorf("expected error on closed conn but returned nil")
+		}
+	})
+}
@@ -0,0 +1,264 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBadProxyHeader is returned when a connection does not begin with a valid
+// PROXY protocol header.
+var ErrBadProxyHeader = errors.New("bad PROXY protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// AppendProxyHeader appends a HAProxy PROXY protocol header of the version, 1
+// or 2, to b and returns the extended buffer. src is the client address and
+// dst is the address the client connected to.
+//
+// Prepend it to the peeked data so that the worker receives it first; see
+// also Dispatcher.ProxyProtocol.
+func AppendProxyHeader(b []byte, version int, src, dst *net.TCPAddr) ([]byte, error) {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	v4 := srcIP != nil && dstIP != nil
+	if !v4 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	if srcIP == nil || dstIP == nil {
+		return b, errors.New("bad address for PROXY protocol header")
+	}
+
+	switch version {
+	case 1:
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return append(b, "PROXY "+proto+" "+srcIP.String()+" "+dstIP.String()+" "+
+			strconv.Itoa(src.Port)+" "+strconv.Itoa(dst.Port)+"\r\n"...), nil
+	case 2:
+		b = append(b, proxyV2Signature...)
+		b = append(b, 0x21) // version 2, PROXY
+		if v4 {
+			b = append(b, 0x11, 0, 12) // TCP over IPv4
+		} else {
+			b = append(b, 0x21, 0, 36) // TCP over IPv6
+		}
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		var ports [4]byte
+		binary.BigEndian.PutUint16(ports[:2], uint16(src.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+		return append(b, ports[:]...), nil
+	}
+	return b, errors.New("unknown PROXY protocol version " + strconv.Itoa(version))
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+//
+// Source and Destination are nil if the sender did not tell the addresses;
+// it is the case of "UNKNOWN" in version 1 and "LOCAL" in version 2.
+type ProxyHeader struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadProxyHeader reads a PROXY protocol header of version 1 or 2 from r. r
+// is not read beyond the header.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(sig) < 6 {
+		return nil, ErrBadProxyHeader
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if string(sig[:6]) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, ErrBadProxyHeader
+}
+
+// maxProxyHeaderV1 is the max length of the version 1 header including CRLF.
+const maxProxyHeaderV1 = 107
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < maxProxyHeaderV1 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrBadProxyHeader
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrBadProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrBadProxyHeader
+	}
+
+	var err error
+	if h.Source, err = parseProxyAddr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseProxyAddr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, ErrBadProxyHeader
+	}
+
+	h := &ProxyHeader{Version: 2}
+	if hdr[12]&0xf == 0 { // LOCAL
+		return h, nil
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// not TCP; the addresses are ignored
+		return h, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, ErrBadProxyHeader
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return h, nil
+}
+
+// ProxyConn is a connection beginning with a PROXY protocol header. The
+// header is stripped from the data, and RemoteAddr and LocalAddr return the
+// addresses in the header.
+//
+// The header is read at the first call of Read, RemoteAddr, LocalAddr or
+// ProxyHeader. If it is missing or broken, Read returns the error.
+type ProxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+// NewProxyConn returns conn wrapped as ProxyConn.
+func NewProxyConn(conn net.Conn) *ProxyConn {
+	return &ProxyConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// ProxyHeader returns the PROXY protocol header of the connection.
+func (c *ProxyConn) ProxyHeader() (*ProxyHeader, error) {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.header, c.err = ReadProxyHeader(c.r)
+	})
+	return c.header, c.err
+}
+
+// Read reads data following the header.
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	if _, err := c.ProxyHeader(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address in the header, or the address of the
+// underlying connection if the header has no address.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if h, _ := c.ProxyHeader(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address in the header, or the address of
+// the underlying connection if the header has no address.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if h, _ := c.ProxyHeader(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxyListener wraps accepted connections as ProxyConn.
+type ProxyListener struct {
+	net.Listener
+
+	// HeaderTimeout limits the time to read the header at the first access
+	// to a connection. Zero means no limit.
+	HeaderTimeout time.Duration
+}
+
+// NewProxyListener returns l wrapped as ProxyListener. It can be used with
+// QueueListener to receive connections handed off with a PROXY header.
+func NewProxyListener(l net.Listener) *ProxyListener {
+	return &ProxyListener{Listener: l}
+}
+
+// Accept waits for and returns the next connection as *ProxyConn.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	pc := NewProxyConn(conn)
+	pc.timeout = l.HeaderTimeout
+	return pc, nil
+}
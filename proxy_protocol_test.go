@@ -0,0 +1,121 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	t.Run("version 1 format", func(t *testing.T) {
+		b, err := AppendProxyHeader(nil, 1, v4src, v4dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"; got != want {
+			t.Errorf("got %q but want %q", got, want)
+		}
+	})
+
+	var tests = []struct {
+		name     string
+		version  int
+		src, dst *net.TCPAddr
+	}{
+		{"v1 ipv4", 1, v4src, v4dst},
+		{"v1 ipv6", 1, v6src, v6dst},
+		{"v2 ipv4", 2, v4src, v4dst},
+		{"v2 ipv6", 2, v6src, v6dst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := AppendProxyHeader(nil, tt.version, tt.src, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b = append(b, "payload"...)
+
+			r := bufio.NewReader(bytes.NewReader(b))
+			h, err := ReadProxyHeader(r)
+			if err != nil {
+				t.Fatalf("ReadProxyHeader error: %v", err)
+			}
+			if h.Version != tt.version {
+				t.Errorf("got version %v but want %v", h.Version, tt.version)
+			}
+			if !h.Source.IP.Equal(tt.src.IP) || h.Source.Port != tt.src.Port {
+				t.Errorf("got source %v but want %v", h.Source, tt.src)
+			}
+			if !h.Destination.IP.Equal(tt.dst.IP) || h.Destination.Port != tt.dst.Port {
+				t.Errorf("got destination %v but want %v", h.Destination, tt.dst)
+			}
+
+			rest, _ := ioutil.ReadAll(r)
+			if got, want := string(rest), "payload"; got != want {
+				t.Errorf("got rest %q but want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("unknown and local", func(t *testing.T) {
+		v2local := append(append([]byte(nil), proxyV2Signature...), 0x20, 0, 0, 0)
+		for _, b := range [][]byte{[]byte("PROXY UNKNOWN\r\n"), v2local} {
+			h, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatalf("%q: ReadProxyHeader error: %v", b, err)
+			}
+			if h.Source != nil || h.Destination != nil {
+				t.Errorf("%q: got addresses %v, %v", b, h.Source, h.Destination)
+			}
+		}
+	})
+
+	t.Run("bad header", func(t *testing.T) {
+		for _, s := range []string{
+			"GET / HTTP/1.1\r\n\r\n",
+			"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+			"PROXY TCP4 192.0.2.1 192.0.2.2 56324 99999\r\n",
+			"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n",
+		} {
+			if _, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader([]byte(s)))); err != ErrBadProxyHeader {
+				t.Errorf("%q: got error `%v` but want `%v`", s, err, ErrBadProxyHeader)
+			}
+		}
+	})
+}
+
+func TestProxyConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80}
+	go func() {
+		b, _ := AppendProxyHeader(nil, 2, src, dst)
+		client.Write(append(b, "hello"...))
+		client.Close()
+	}()
+
+	pc := NewProxyConn(server)
+	if got := pc.RemoteAddr(); !reflect.DeepEqual(got, &net.TCPAddr{IP: src.IP.To4(), Port: src.Port}) {
+		t.Errorf("got remote address %v but want %v", got, src)
+	}
+	if got := pc.LocalAddr().String(); got != dst.String() {
+		t.Errorf("got local address %v but want %v", got, dst)
+	}
+	b, err := ioutil.ReadAll(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "hello"; got != want {
+		t.Errorf("got %q but want %q", got, want)
+	}
+}
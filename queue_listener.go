@@ -2,78 +2,315 @@ package ipc
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 // QueueListener is a Listener accept from queue; it implements net.Listener
 // interface.
 // TCPConn received from the IPC peer should be pushed to this.
 type QueueListener struct {
-	ch       chan net.Conn
-	m        sync.Mutex // guard ch
+	// OnClose is called by Close with each connection still queued. If nil,
+	// the connections are closed. See also HandBackQueued.
+	OnClose func(c net.Conn)
+
+	ch     chan queuedConn // never closed; see done
+	done   chan struct{}   // closed by Close
+	pushWG sync.WaitGroup  // running Push
+
+	m        sync.Mutex // guard below
 	isClosed bool
-	addr     queueAddr
+	deadline time.Time
+	changed  chan struct{} // closed when deadline is changed
+	stats    QueueStats
+
+	addr queueAddr
+}
+
+type queuedConn struct {
+	conn     net.Conn
+	pushedAt time.Time
+}
+
+// QueueStats is the statistics of a QueueListener.
+type QueueStats struct {
+	Len      int           // connections in the queue
+	Cap      int           // capacity of the queue
+	Pushed   uint64        // connections pushed
+	Accepted uint64        // connections accepted
+	Rejected uint64        // TryPush failed because the queue was full
+	WaitSum  time.Duration // sum of the time accepted connections were queued
+	WaitMax  time.Duration // longest time an accepted connection was queued
 }
 
 // Push pushes a net.Conn to the queue.
 //
 // The queue has capacity specified at the creation; Push blocks the call if
-// there is no space.
+// there is no space. If the listener is closed while waiting, Push returns
+// ErrClosedQueue.
 func (l *QueueListener) Push(ctx context.Context, c net.Conn) error {
-	l.m.Lock()
-	defer l.m.Unlock()
-
-	if l.isClosed {
-		return ErrClosedQueue
+	if err := l.beginPush(); err != nil {
+		return err
 	}
+	defer l.pushWG.Done()
 
 	if ctx == nil {
 		ctx = context.Background()
 	}
 	select {
-	case l.ch <- c:
+	case l.ch <- queuedConn{c, time.Now()}:
+		l.countPushed()
 		return nil
+	case <-l.done:
+		return ErrClosedQueue
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 }
 
+// TryPush pushes a net.Conn to the queue if there is space; otherwise it
+// returns ErrQueueFull immediately.
+func (l *QueueListener) TryPush(c net.Conn) error {
+	if err := l.beginPush(); err != nil {
+		return err
+	}
+	defer l.pushWG.Done()
+
+	select {
+	case l.ch <- queuedConn{c, time.Now()}:
+		l.countPushed()
+		return nil
+	default:
+		l.m.Lock()
+		l.stats.Rejected++
+		l.m.Unlock()
+		return ErrQueueFull
+	}
+}
+
+// beginPush registers a running Push; Close waits for it.
+func (l *QueueListener) beginPush() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.isClosed {
+		return ErrClosedQueue
+	}
+	l.pushWG.Add(1)
+	return nil
+}
+
+func (l *QueueListener) countPushed() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.stats.Pushed++
+}
+
 // Accept implements the Accept method in the net.Listener interface; it waits
 // for the next push to the queue.
 //
-// If the listener closed while waiting, Accept returns ErrClosedQueue.
+// If the listener closed while waiting, Accept returns ErrClosedQueue. If the
+// deadline set by SetDeadline is exceeded, Accept returns ErrTimeout.
 func (l *QueueListener) Accept() (net.Conn, error) {
-	if l.isClosed {
-		return nil, ErrClosedQueue
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept but also returns the error of ctx if ctx is
+// done while waiting.
+func (l *QueueListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	for {
+		l.m.Lock()
+		closed, deadline, changed := l.isClosed, l.deadline, l.changed
+		l.m.Unlock()
+		if closed {
+			return nil, ErrClosedQueue
+		}
+
+		conn, retry, err := l.waitAccept(ctx, deadline, changed)
+		if !retry {
+			return conn, err
+		}
 	}
+}
 
-	tcp, ok := <-l.ch
-	if !ok {
-		return nil, ErrClosedQueue
+// waitAccept waits for the next push until the deadline. It returns true if
+// the deadline is changed while waiting.
+func (l *QueueListener) waitAccept(ctx context.Context, deadline time.Time, changed chan struct{}) (net.Conn, bool, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, false, ErrTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case q := <-l.ch:
+		l.countAccepted(q)
+		return q.conn, false, nil
+	case <-l.done:
+		return nil, false, ErrClosedQueue
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case <-timeout:
+		return nil, false, ErrTimeout
+	case <-changed:
+		return nil, true, nil
 	}
-	return tcp, nil
+}
+
+func (l *QueueListener) countAccepted(q queuedConn) {
+	wait := time.Since(q.pushedAt)
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.stats.Accepted++
+	l.stats.WaitSum += wait
+	if wait > l.stats.WaitMax {
+		l.stats.WaitMax = wait
+	}
+}
+
+// SetDeadline sets the deadline of Accept, including the blocked one. A zero
+// value disables the deadline.
+func (l *QueueListener) SetDeadline(t time.Time) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.deadline = t
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return nil
+}
+
+// Stats returns the statistics of the listener.
+func (l *QueueListener) Stats() QueueStats {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	s := l.stats
+	s.Len = len(l.ch)
+	s.Cap = cap(l.ch)
+	return s
 }
 
 // Close closes the listener.
-// Any blocked Accept operations will be unblocked and return errors.
+// Any blocked Accept and Push operations will be unblocked and return errors.
+// The connections still queued are given to OnClose.
 func (l *QueueListener) Close() error {
 	l.m.Lock()
-	defer l.m.Unlock()
 	if l.isClosed {
+		l.m.Unlock()
 		return nil
 	}
 	l.isClosed = true
+	close(l.done)
+	l.m.Unlock()
+
+	// no Push can begin now; wait for the running ones to leave
+	l.pushWG.Wait()
 
-	if len(l.ch) > 0 {
-		// vacuume channel and close connections
-		for c := range l.ch {
-			c.Close()
+	for {
+		select {
+		case q := <-l.ch:
+			if l.OnClose != nil {
+				l.OnClose(q.conn)
+			} else {
+				q.conn.Close()
+			}
+		default:
+			return nil
 		}
 	}
+}
 
-	close(l.ch)
-	return nil
+// HandBackQueued returns a function for QueueListener.OnClose; it hands the
+// connections back over c with Conn.HandBack, or closes them if it fails.
+func HandBackQueued(c *Conn) func(net.Conn) {
+	return func(conn net.Conn) {
+		if err := c.HandBack(conn, nil, nil); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// Feed receives TCP connections from c and pushes them to the queue; it is
+// the worker side of Dispatcher. Trailing data of the connections is kept as
+// ConnInfo.Msg; see HandoffInfo.
+//
+// A connection passed with SendTCPConnWithAck is accepted once it is pushed,
+// and refused if it can not be pushed before the deadline of the sender.
+//
+// Feed returns nil when the peer closes c, or an error. Neither c nor the
+// listener is closed by Feed.
+func (l *QueueListener) Feed(c *Conn) error {
+	for {
+		cmd, err := c.ReceiveCommand()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch cmd {
+		case TCPConnCommand:
+			tcp, h, withData, err := c.ReceiveTCPConnWithAck()
+			if err != nil {
+				return err
+			}
+			if withData {
+				msg, err := c.ReceiveData()
+				if err != nil {
+					tcp.Close()
+					return err
+				}
+				setHandoffMsg(tcp, msg)
+			}
+			if err := l.feed(tcp, h); err != nil {
+				return err
+			}
+		case DataCommand:
+			if _, err := c.ReceiveData(); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unexpected command " + cmd.String())
+		}
+	}
+}
+
+func (l *QueueListener) feed(tcp net.Conn, h *Handoff) error {
+	if h == nil {
+		if err := l.Push(context.Background(), tcp); err != nil {
+			tcp.Close()
+			return err
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	if deadline := h.Deadline(); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	switch err := l.Push(ctx, tcp); err {
+	case nil:
+		return h.Accept()
+	case context.DeadlineExceeded:
+		return h.Refuse()
+	default:
+		h.Refuse()
+		return err
+	}
 }
 
 // Addr returns the listener's network address.
@@ -88,9 +325,10 @@ func (l *QueueListener) Addr() net.Addr {
 // Accept.
 func NewQueueListener(backlog uint) *QueueListener {
 	return &QueueListener{
-		ch:       make(chan net.Conn, backlog),
-		isClosed: false,
-		addr:     queueAddr{},
+		ch:      make(chan queuedConn, backlog),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+		addr:    queueAddr{},
 	}
 }
 
@@ -0,0 +1,143 @@
+package ipc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// closeRecorder is a net.Conn recording Close.
+type closeRecorder struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func newCloseRecorder() *closeRecorder {
+	return &closeRecorder{closed: make(chan struct{})}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *closeRecorder) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestQueueListener(t *testing.T) {
+	t.Run("close with queued connections", func(t *testing.T) {
+		l := NewQueueListener(2)
+		c1, c2 := newCloseRecorder(), newCloseRecorder()
+		l.Push(nil, c1)
+		l.Push(nil, c2)
+
+		done := make(chan struct{})
+		go func() {
+			l.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Close is blocked")
+		}
+		if !c1.isClosed() || !c2.isClosed() {
+			t.Error("queued connections are not closed")
+		}
+	})
+
+	t.Run("close while push is blocked", func(t *testing.T) {
+		l := NewQueueListener(0)
+		pushed := make(chan error)
+		c := newCloseRecorder()
+		go func() { pushed <- l.Push(context.Background(), c) }()
+		time.Sleep(10 * time.Millisecond)
+
+		l.Close()
+		if got, want := <-pushed, ErrClosedQueue; got != want {
+			t.Errorf("Push returned `%v` but want `%v`", got, want)
+		}
+		if _, err := l.Accept(); err != ErrClosedQueue {
+			t.Errorf("Accept returned `%v` but want `%v`", err, ErrClosedQueue)
+		}
+	})
+
+	t.Run("try push", func(t *testing.T) {
+		l := NewQueueListener(1)
+		defer l.Close()
+		if err := l.TryPush(newCloseRecorder()); err != nil {
+			t.Fatalf("TryPush error: %v", err)
+		}
+		if got, want := l.TryPush(newCloseRecorder()), ErrQueueFull; got != want {
+			t.Errorf("TryPush returned `%v` but want `%v`", got, want)
+		}
+		s := l.Stats()
+		if s.Len != 1 || s.Cap != 1 || s.Pushed != 1 || s.Rejected != 1 {
+			t.Errorf("unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("accept deadline", func(t *testing.T) {
+		l := NewQueueListener(1)
+		defer l.Close()
+
+		accepted := make(chan error)
+		go func() {
+			_, err := l.Accept()
+			accepted <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// the blocked Accept sees the new deadline
+		l.SetDeadline(time.Now().Add(10 * time.Millisecond))
+		select {
+		case err := <-accepted:
+			if err != ErrTimeout {
+				t.Errorf("Accept returned `%v` but want `%v`", err, ErrTimeout)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Accept is not timed out")
+		}
+
+		l.SetDeadline(time.Time{})
+		c := newCloseRecorder()
+		l.Push(nil, c)
+		if got, err := l.Accept(); err != nil || got != c {
+			t.Errorf("Accept returned %v, %v", got, err)
+		}
+		if s := l.Stats(); s.Accepted != 1 || s.WaitSum < s.WaitMax {
+			t.Errorf("unexpected stats: %+v", s)
+		}
+	})
+
+	t.Run("accept context", func(t *testing.T) {
+		l := NewQueueListener(1)
+		defer l.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := l.AcceptContext(ctx); err != context.DeadlineExceeded {
+			t.Errorf("AcceptContext returned `%v` but want `%v`", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("close policy", func(t *testing.T) {
+		l := NewQueueListener(1)
+		var handed []net.Conn
+		l.OnClose = func(c net.Conn) { handed = append(handed, c) }
+		c := newCloseRecorder()
+		l.Push(nil, c)
+		l.Close()
+
+		if len(handed) != 1 || handed[0] != c || c.isClosed() {
+			t.Errorf("queued connection is not given to OnClose")
+		}
+	})
+}
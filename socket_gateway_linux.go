@@ -1,8 +1,11 @@
 package ipc
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -12,38 +15,57 @@ type socketGateway struct {
 	gateway
 }
 
-func (gw *socketGateway) send(conn net.Conn, sock *net.TCPConn, peeked, msg []byte) (err error) {
-	rawSock, err := sock.SyscallConn()
+// send passes sock to the peer. sock must be a *net.TCPConn or a TCPConn
+// received from a peer; it is left open and the caller closes it when the
+// passing is completed. seq and deadline are the acknowledgement request; zero
+// seq requests no acknowledgement, and zero deadline no time limit.
+func (gw *socketGateway) send(conn net.Conn, sock net.Conn, peeked, msg []byte, seq uint32, deadline time.Time) (err error) {
+	sc, ok := sock.(syscall.Conn)
+	laddr, _ := sock.LocalAddr().(*net.TCPAddr)
+	raddr, _ := sock.RemoteAddr().(*net.TCPAddr)
+	if !ok || laddr == nil || raddr == nil {
+		return fmt.Errorf("unsupported connection %T", sock)
+	}
+	rawSock, err := sc.SyscallConn()
 	if err != nil {
 		return
 	}
 
+	sentAt := time.Now()
+	var timeout time.Duration
+	if !deadline.IsZero() {
+		// zero would mean no time limit
+		if timeout = deadline.Sub(sentAt); timeout <= 0 {
+			timeout = 1
+		}
+	}
+
 	rawSock.Control(func(fd uintptr) {
 		err = gw.sendImpl(conn,
 			int(fd),
 			&socketData{
-				laddr:    *sock.LocalAddr().(*net.TCPAddr),
-				raddr:    *sock.RemoteAddr().(*net.TCPAddr),
+				laddr:    *laddr,
+				raddr:    *raddr,
 				peeked:   peeked,
 				withData: len(msg) > 0,
+				ackSeq:   seq,
+				ackTime:  timeout,
+				sentAt:   sentAt,
 			},
 			msg)
 	})
 
-	if err == nil {
-		sock.Close()
-	}
 	return
 }
 
-func (gw *socketGateway) receive(conn net.Conn) (sk *sysSocket, laddr net.TCPAddr, raddr net.TCPAddr, peeked []byte, withMsg bool, err error) {
-	var sd socketData
-	fd, err := gw.receiveImpl(conn, &sd)
+func (gw *socketGateway) receive(conn net.Conn) (sk *sysSocket, sd *socketData, err error) {
+	sd = &socketData{}
+	fd, err := gw.receiveImpl(conn, sd)
 	if err != nil {
 		return
 	}
 
-	return &sysSocket{fd: fd}, sd.laddr, sd.raddr, sd.peeked, sd.withData, nil
+	return &sysSocket{fd: fd}, sd, nil
 }
 
 func newSocketGateway() *socketGateway {
@@ -55,6 +77,9 @@ type socketData struct {
 	raddr    net.TCPAddr
 	peeked   []byte
 	withData bool
+	ackSeq   uint32        // non-zero if an acknowledgement is requested
+	ackTime  time.Duration // time limit of the acknowledgement, or zero
+	sentAt   time.Time
 }
 
 func (sd *socketData) serialize(w io.Writer) error {
@@ -71,6 +96,11 @@ func (sd *socketData) serialize(w io.Writer) error {
 	bw.writeBytes(sd.peeked)
 	// withData
 	bw.write(sd.withData)
+	// ack
+	bw.write(sd.ackSeq)
+	bw.write(int64(sd.ackTime))
+	// sentAt
+	bw.write(sd.sentAt.UnixNano())
 	return bw.err
 }
 
@@ -91,15 +121,28 @@ func (sd *socketData) deserialize(r io.Reader) error {
 	sd.peeked = br.readBytes()
 	// withData
 	br.read(&sd.withData)
+	// ack
+	var i64 int64
+	br.read(&sd.ackSeq)
+	br.read(&i64)
+	sd.ackTime = time.Duration(i64)
+	// sentAt
+	br.read(&i64)
+	sd.sentAt = time.Unix(0, i64)
 	return br.err
 }
 
 type sysSocket struct {
 	fd            int
+	m             sync.Mutex // guard deadlines
 	readDeadline  time.Time
 	writeDeadline time.Time
 }
 
+// deadlinePollInterval is the longest time a blocked operation takes to notice
+// a change of the deadline.
+const deadlinePollInterval = 100 * time.Millisecond
+
 func (s *sysSocket) read(b []byte) (n int, err error) {
 	for {
 		n, _, err = unix.Recvfrom(s.fd, b, 0)
@@ -167,11 +210,15 @@ func (s *sysSocket) setDeadline(t time.Time) error {
 }
 
 func (s *sysSocket) setReadDeadline(t time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
 	s.readDeadline = t
 	return nil
 }
 
 func (s *sysSocket) setWriteDeadline(t time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
 	s.writeDeadline = t
 	return nil
 }
@@ -181,34 +228,37 @@ func (s *sysSocket) isReadableState() (bool, error) {
 }
 
 func (s *sysSocket) waitUntilReadable() (bool, error) {
-	to, err := deadlineToTimeval(s.readDeadline)
-	if err != nil {
-		return false, err
-	}
-	return waitIOEvent(waitRead, s.fd, to)
+	return s.wait(waitRead, &s.readDeadline)
 }
 
 func (s *sysSocket) waitUntilWritable() (bool, error) {
-	to, err := deadlineToTimeval(s.writeDeadline)
-	if err != nil {
-		return false, err
-	}
-	return waitIOEvent(waitWrite, s.fd, to)
+	return s.wait(waitWrite, &s.writeDeadline)
 }
 
-func deadlineToTimeval(t time.Time) (*unix.Timeval, error) {
-	if t.IsZero() {
-		return waitForever, nil
-	}
+// wait waits until the socket is ready or the deadline is exceeded. The wait
+// is split by deadlinePollInterval so that a deadline changed while waiting,
+// e.g. to interrupt a blocked Read, takes effect.
+func (s *sysSocket) wait(mode int, deadline *time.Time) (bool, error) {
+	for {
+		s.m.Lock()
+		t := *deadline
+		s.m.Unlock()
 
-	now := time.Now()
-	if t.Before(now) {
-		return nil, ErrTimeout
-	}
+		d := deadlinePollInterval
+		if !t.IsZero() {
+			left := time.Until(t)
+			if left <= 0 {
+				return false, ErrTimeout
+			}
+			if left < d {
+				d = left
+			}
+		}
 
-	subt := t.Sub(now)
-	tv := unix.Timeval{}
-	tv.Sec = int64(subt.Seconds())
-	tv.Usec = int64(subt/1000) - tv.Sec*1000*1000
-	return &tv, nil
+		tv := unix.NsecToTimeval(d.Nanoseconds())
+		ok, err := waitIOEvent(mode, s.fd, &tv)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
 }
@@ -1,8 +1,11 @@
 package ipc
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -14,18 +17,40 @@ type socketGateway struct {
 	gateway
 }
 
-func (gw *socketGateway) send(conn net.Conn, sock *net.TCPConn, peeked, msg []byte) (err error) {
-	rawSock, err := sock.SyscallConn()
+// send passes sock to the peer. sock must be a *net.TCPConn or a TCPConn
+// received from a peer; it is left open and the caller closes it when the
+// passing is completed. seq and deadline are the acknowledgement request; zero
+// seq requests no acknowledgement, and zero deadline no time limit.
+func (gw *socketGateway) send(conn net.Conn, sock net.Conn, peeked, msg []byte, seq uint32, deadline time.Time) (err error) {
+	sc, ok := sock.(syscall.Conn)
+	laddr, _ := sock.LocalAddr().(*net.TCPAddr)
+	raddr, _ := sock.RemoteAddr().(*net.TCPAddr)
+	if !ok || laddr == nil || raddr == nil {
+		return fmt.Errorf("unsupported connection %T", sock)
+	}
+	rawSock, err := sc.SyscallConn()
 	if err != nil {
 		return
 	}
 
+	sentAt := time.Now()
+	var timeout time.Duration
+	if !deadline.IsZero() {
+		// zero would mean no time limit
+		if timeout = deadline.Sub(sentAt); timeout <= 0 {
+			timeout = 1
+		}
+	}
+
 	rawSock.Control(func(fd uintptr) {
 		sd := socketData{
-			laddr:    *sock.LocalAddr().(*net.TCPAddr),
-			raddr:    *sock.RemoteAddr().(*net.TCPAddr),
+			laddr:    *laddr,
+			raddr:    *raddr,
 			peeked:   peeked,
 			withData: len(msg) > 0,
+			ackSeq:   seq,
+			ackTime:  timeout,
+			sentAt:   sentAt,
 		}
 
 		err = gw.sendImpl(conn, msg, func() (s serializer, err error) {
@@ -36,16 +61,13 @@ func (gw *socketGateway) send(conn net.Conn, sock *net.TCPConn, peeked, msg []by
 			return &sd, nil
 		})
 	})
-	if err == nil {
-		sock.Close()
-	}
 	return
 }
 
-func (gw *socketGateway) receive(conn net.Conn) (sk *sysSocket, laddr net.TCPAddr, raddr net.TCPAddr, peeked []byte, withMsg bool, err error) {
-	var sd socketData
+func (gw *socketGateway) receive(conn net.Conn) (sk *sysSocket, sd *socketData, err error) {
+	sd = &socketData{}
 
-	err = gw.receiveImpl(conn, &sd)
+	err = gw.receiveImpl(conn, sd)
 	if err != nil {
 		return
 	}
@@ -69,7 +91,7 @@ func (gw *socketGateway) receive(conn net.Conn) (sk *sysSocket, laddr net.TCPAdd
 		return
 	}
 
-	return &sysSocket{fd: fd}, sd.laddr, sd.raddr, sd.peeked, sd.withData, nil
+	return &sysSocket{fd: fd}, sd, nil
 }
 
 func newSocketGateway() *socketGateway {
@@ -82,6 +104,9 @@ type socketData struct {
 	raddr        net.TCPAddr
 	peeked       []byte
 	withData     bool
+	ackSeq       uint32        // non-zero if an acknowledgement is requested
+	ackTime      time.Duration // time limit of the acknowledgement, or zero
+	sentAt       time.Time
 }
 
 func (sd *socketData) serialize(w io.Writer) error {
@@ -124,6 +149,11 @@ func (sd *socketData) serialize(w io.Writer) error {
 	bw.writeBytes(sd.peeked)
 	// withData
 	bw.write(sd.withData)
+	// ack
+	bw.write(sd.ackSeq)
+	bw.write(int64(sd.ackTime))
+	// sentAt
+	bw.write(sd.sentAt.UnixNano())
 	return bw.err
 }
 
@@ -171,15 +201,28 @@ func (sd *socketData) deserialize(r io.Reader) error {
 	sd.peeked = br.readBytes()
 	// withData
 	br.read(&sd.withData)
+	// ack
+	var i64 int64
+	br.read(&sd.ackSeq)
+	br.read(&i64)
+	sd.ackTime = time.Duration(i64)
+	// sentAt
+	br.read(&i64)
+	sd.sentAt = time.Unix(0, i64)
 	return br.err
 }
 
 type sysSocket struct {
 	fd            windows.Handle
+	m             sync.Mutex // guard deadlines
 	readDeadline  time.Time
 	writeDeadline time.Time
 }
 
+// deadlinePollInterval is the longest time a blocked operation takes to notice
+// a change of the deadline.
+const deadlinePollInterval = 100 * time.Millisecond
+
 func (s *sysSocket) read(b []byte) (n int, err error) {
 	var read uint32
 	var flags uint32
@@ -262,11 +305,15 @@ func (s *sysSocket) setDeadline(t time.Time) error {
 }
 
 func (s *sysSocket) setReadDeadline(t time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
 	s.readDeadline = t
 	return nil
 }
 
 func (s *sysSocket) setWriteDeadline(t time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
 	s.writeDeadline = t
 	return nil
 }
@@ -293,19 +340,38 @@ func (s *sysSocket) isReadableState() (bool, error) {
 }
 
 func (s *sysSocket) waitUntilReadable() (bool, error) {
-	to, err := deadlineToTimeout(s.readDeadline)
-	if err != nil {
-		return false, err
-	}
-	return waitIOEvent(waitRead, s.fd, to)
+	return s.wait(waitRead, &s.readDeadline)
 }
 
 func (s *sysSocket) waitUntilWritable() (bool, error) {
-	to, err := deadlineToTimeout(s.writeDeadline)
-	if err != nil {
-		return false, err
+	return s.wait(waitWrite, &s.writeDeadline)
+}
+
+// wait waits until the socket is ready or the deadline is exceeded. The wait
+// is split by deadlinePollInterval so that a deadline changed while waiting,
+// e.g. to interrupt a blocked Read, takes effect.
+func (s *sysSocket) wait(mode int, deadline *time.Time) (bool, error) {
+	for {
+		s.m.Lock()
+		t := *deadline
+		s.m.Unlock()
+
+		d := deadlinePollInterval
+		if !t.IsZero() {
+			left := time.Until(t)
+			if left <= 0 {
+				return false, ErrTimeout
+			}
+			if left < d {
+				d = left
+			}
+		}
+
+		ok, err := waitIOEvent(mode, s.fd, uint32(d/time.Millisecond))
+		if ok || err != nil {
+			return ok, err
+		}
 	}
-	return waitIOEvent(waitWrite, s.fd, to)
 }
 
 const (
@@ -340,16 +406,3 @@ func waitIOEvent(mode int, fd windows.Handle, timeout uint32) (bool, error) {
 
 	return ret == winsys.WSA_WAIT_EVENT_0, nil
 }
-
-func deadlineToTimeout(t time.Time) (uint32, error) {
-	if t.IsZero() {
-		return windows.INFINITE, nil
-	}
-
-	now := time.Now()
-	if t.Before(now) {
-		return 0, ErrTimeout
-	}
-
-	return uint32(t.Sub(now).Milliseconds()), nil
-}
@@ -0,0 +1,475 @@
+package ipc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// supervisorEnv is the environment variable telling a worker started by
+// Supervisor the descriptor of the IPC connection.
+const supervisorEnv = "GO_IPC_SUPERVISOR_FD"
+
+// Default values of Supervisor.
+const (
+	DefaultStopTimeout = 30 * time.Second
+	DefaultMinBackoff  = 100 * time.Millisecond
+	DefaultMaxBackoff  = 30 * time.Second
+
+	DefaultRestartWindow = time.Minute
+)
+
+// SupervisorConn returns the connection to the Supervisor which started the
+// process, or ErrNoParent. The worker calls ReportReady on it when it is ready
+// to receive connections.
+func SupervisorConn() (*Conn, error) {
+	return fromParent(supervisorEnv)
+}
+
+// ReportReady tells the Supervisor that this worker is ready; connections are
+// passed to the worker after that.
+func ReportReady(c *Conn) error {
+	return c.sendMessage(&workerMessage{Kind: workerReady})
+}
+
+// Supervisor spawns N worker processes connected to it by IPC connections,
+// and restarts them when they exit. The workers are registered to Dispatcher
+// while they are ready:
+//
+//	s := &ipc.Supervisor{
+//		N:          4,
+//		Command:    func(i int) *exec.Cmd { return exec.Command("worker") },
+//		Dispatcher: d,
+//	}
+//	if err := s.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	go d.Serve()
+//	err := s.Wait()
+//
+// A worker gets the connection with SupervisorConn and calls ReportReady. On
+// stop, a worker is removed from the dispatcher and sent StopSignal; it should
+// finish its work and exit, and is killed after the timeout. The connection
+// is kept open meanwhile, so that the worker can hand connections back.
+//
+// It is supported on linux only.
+type Supervisor struct {
+	// N is the number of the workers.
+	N int
+
+	// Command returns the command of the worker in the i-th slot. It is
+	// called on each start of the worker.
+	Command func(i int) *exec.Cmd
+
+	// Dispatcher is the dispatcher the workers are registered to; a worker
+	// is named after its slot so that ConsistentHash keeps clients on its
+	// replacement. If nil, the connections are got with Conns.
+	Dispatcher *Dispatcher
+
+	// ReadyTimeout limits the time a worker takes to call ReportReady. If
+	// zero, DefaultReadyTimeout is used.
+	ReadyTimeout time.Duration
+
+	// StopSignal is sent to a worker to stop it. If nil, SIGTERM is used.
+	StopSignal os.Signal
+
+	// StopTimeout is the time a worker replaced by RollingRestart has to
+	// exit before it is killed. If zero, DefaultStopTimeout is used.
+	StopTimeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the delay before a restart; the delay
+	// doubles for each restart of the slot within RestartWindow. If zero,
+	// DefaultMinBackoff and DefaultMaxBackoff are used.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxRestarts is the number of restarts of all the slots allowed within
+	// RestartWindow. When it is exceeded, the supervisor stops all the
+	// workers and Wait returns ErrCrashLoop. If zero, workers are restarted
+	// forever. If RestartWindow is zero, DefaultRestartWindow is used.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	m        sync.Mutex // guard below
+	slots    []*supervisedWorker
+	restarts [][]time.Time // per slot, within RestartWindow
+	stopped  bool
+	err      error
+	done     chan struct{} // closed when stopped; see doneLocked
+
+	rollingM sync.Mutex     // serialize RollingRestart
+	wg       sync.WaitGroup // watching and restarting goroutines
+}
+
+type supervisedWorker struct {
+	cmd    *exec.Cmd
+	conn   *Conn
+	worker *Worker // nil without Dispatcher
+	exited chan struct{}
+}
+
+// Start starts the workers and waits until they are ready. If one fails, the
+// workers started are stopped, or killed after StopTimeout, and the error is
+// returned.
+func (s *Supervisor) Start() error {
+	s.m.Lock()
+	if s.stopped {
+		s.m.Unlock()
+		return errSupervisorStopped
+	}
+	s.slots = make([]*supervisedWorker, s.N)
+	s.restarts = make([][]time.Time, s.N)
+	s.m.Unlock()
+
+	for i := 0; i < s.N; i++ {
+		w, err := s.spawn(i)
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.stopTimeout())
+			s.Stop(ctx)
+			cancel()
+			return err
+		}
+		s.m.Lock()
+		s.slots[i] = w
+		s.m.Unlock()
+		s.watch(i, w)
+	}
+	return nil
+}
+
+// Conns returns the connections to the workers ready. They are owned by
+// Dispatcher if it is set.
+func (s *Supervisor) Conns() []*Conn {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var conns []*Conn
+	for _, w := range s.slots {
+		if w != nil {
+			conns = append(conns, w.conn)
+		}
+	}
+	return conns
+}
+
+// RollingRestart replaces the workers one by one: it starts a new worker,
+// waits until it is ready, then stops the old one. If a new worker fails, the
+// error is returned and the rest of the old workers are kept.
+func (s *Supervisor) RollingRestart(ctx context.Context) error {
+	s.rollingM.Lock()
+	defer s.rollingM.Unlock()
+
+	for i := 0; i < s.N; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		w, err := s.spawn(i)
+		if err != nil {
+			return err
+		}
+
+		s.m.Lock()
+		if s.stopped {
+			s.m.Unlock()
+			s.watch(i, w)
+			s.stop(ctx, w)
+			return errSupervisorStopped
+		}
+		old := s.slots[i]
+		s.slots[i] = w
+		s.m.Unlock()
+		s.watch(i, w)
+
+		if old != nil {
+			sctx, cancel := context.WithTimeout(ctx, s.stopTimeout())
+			s.stop(sctx, old)
+			cancel()
+		}
+	}
+	return nil
+}
+
+// Stop stops all the workers and waits for them to exit. The workers still
+// running when ctx is done are killed.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	ws := s.shutdown(nil)
+
+	var wg sync.WaitGroup
+	for _, w := range ws {
+		wg.Add(1)
+		go func(w *supervisedWorker) {
+			defer wg.Done()
+			s.stop(ctx, w)
+		}(w)
+	}
+	wg.Wait()
+	s.wg.Wait()
+	return ctx.Err()
+}
+
+// Wait waits until the supervisor is stopped. It returns ErrCrashLoop if the
+// supervisor gave up restarting, or nil after Stop.
+func (s *Supervisor) Wait() error {
+	s.m.Lock()
+	done := s.doneLocked()
+	s.m.Unlock()
+
+	<-done
+	s.wg.Wait()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+// shutdown marks the supervisor stopped with err, and returns the workers
+// running.
+func (s *Supervisor) shutdown(err error) []*supervisedWorker {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	s.err = err
+	close(s.doneLocked())
+
+	var ws []*supervisedWorker
+	for i, w := range s.slots {
+		if w != nil {
+			ws = append(ws, w)
+			s.slots[i] = nil
+		}
+	}
+	return ws
+}
+
+// doneLocked returns the channel closed when the supervisor is stopped; it is
+// made on the first use so that Stop and Wait work before Start. s.m must be
+// held.
+func (s *Supervisor) doneLocked() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// spawn starts the worker of slot i and waits until it is ready. It gives up
+// if the supervisor is stopped meanwhile.
+func (s *Supervisor) spawn(i int) (*supervisedWorker, error) {
+	s.m.Lock()
+	done := s.doneLocked()
+	s.m.Unlock()
+
+	cmd := s.Command(i)
+	conn, err := startChild(cmd, supervisorEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := s.ReadyTimeout
+	if timeout == 0 {
+		timeout = DefaultReadyTimeout
+	}
+	result := make(chan error, 1)
+	go func() { result <- waitWorkerReady(conn) }()
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = ErrTimeout
+	case <-done:
+		err = errSupervisorStopped
+	}
+	if err != nil {
+		conn.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	w := &supervisedWorker{cmd: cmd, conn: conn, exited: make(chan struct{})}
+	if s.Dispatcher != nil {
+		w.worker = s.Dispatcher.AddWorker(conn)
+		w.worker.SetName(strconv.Itoa(i))
+	}
+	return w, nil
+}
+
+func waitWorkerReady(c *Conn) error {
+	for {
+		cmd, err := c.ReceiveCommand()
+		if err == io.EOF {
+			return errors.New("worker exited before ready")
+		}
+		if err != nil {
+			return err
+		}
+		if cmd != DataCommand {
+			return errors.New("unexpected command " + cmd.String())
+		}
+
+		var m workerMessage
+		if err := c.receiveMessage(&m); err != nil {
+			return err
+		}
+		if m.Kind == workerReady {
+			return nil
+		}
+	}
+}
+
+// watch waits for w to exit and restarts it unless it is replaced or
+// stopped.
+func (s *Supervisor) watch(i int, w *supervisedWorker) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		w.cmd.Wait()
+		if w.worker != nil {
+			// the dispatcher closes the connection
+			s.Dispatcher.RemoveWorker(w.worker)
+		} else {
+			w.conn.Close()
+		}
+		close(w.exited)
+
+		s.m.Lock()
+		defer s.m.Unlock()
+		if s.stopped || s.slots[i] != w {
+			return
+		}
+		s.slots[i] = nil
+		s.wg.Add(1)
+		go s.restart(i)
+	}()
+}
+
+// restart starts the worker of slot i again after the backoff.
+func (s *Supervisor) restart(i int) {
+	defer s.wg.Done()
+
+	for {
+		delay, ok := s.recordRestart(i)
+		if !ok {
+			for _, w := range s.shutdown(ErrCrashLoop) {
+				sctx, cancel := context.WithTimeout(context.Background(), s.stopTimeout())
+				s.stop(sctx, w)
+				cancel()
+			}
+			return
+		}
+
+		s.m.Lock()
+		done := s.doneLocked()
+		s.m.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return
+		}
+
+		w, err := s.spawn(i)
+		if err != nil {
+			continue
+		}
+
+		s.m.Lock()
+		if s.stopped || s.slots[i] != nil {
+			// stopped or replaced by RollingRestart meanwhile
+			s.m.Unlock()
+			s.watch(i, w)
+			sctx, cancel := context.WithTimeout(context.Background(), s.stopTimeout())
+			s.stop(sctx, w)
+			cancel()
+			return
+		}
+		s.slots[i] = w
+		s.m.Unlock()
+		s.watch(i, w)
+		return
+	}
+}
+
+// recordRestart records a restart of slot i, and returns the backoff. It
+// returns false if the restart exceeds MaxRestarts.
+func (s *Supervisor) recordRestart(i int) (time.Duration, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	window := s.RestartWindow
+	if window == 0 {
+		window = DefaultRestartWindow
+	}
+	now := time.Now()
+	recent := s.restarts[i][:0]
+	for _, t := range s.restarts[i] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	s.restarts[i] = recent
+
+	if s.MaxRestarts > 0 {
+		total := 0
+		for _, r := range s.restarts {
+			total += len(r)
+		}
+		if total > s.MaxRestarts {
+			return 0, false
+		}
+	}
+
+	min, max := s.MinBackoff, s.MaxBackoff
+	if min == 0 {
+		min = DefaultMinBackoff
+	}
+	if max == 0 {
+		max = DefaultMaxBackoff
+	}
+	delay := min
+	for n := 1; n < len(recent) && delay < max; n++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay, true
+}
+
+// stop removes w from the dispatcher, sends StopSignal and waits for it to
+// exit. It is killed when ctx is done.
+func (s *Supervisor) stop(ctx context.Context, w *supervisedWorker) {
+	if w.worker != nil {
+		s.Dispatcher.RemoveWorker(w.worker)
+	}
+
+	sig := s.StopSignal
+	if sig == nil {
+		sig = syscall.SIGTERM
+	}
+	w.cmd.Process.Signal(sig)
+
+	select {
+	case <-w.exited:
+	case <-ctx.Done():
+		w.cmd.Process.Kill()
+		<-w.exited
+	}
+}
+
+func (s *Supervisor) stopTimeout() time.Duration {
+	if s.StopTimeout == 0 {
+		return DefaultStopTimeout
+	}
+	return s.StopTimeout
+}
@@ -0,0 +1,251 @@
+package ipc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const supervisorChildEnv = "GO_IPC_TEST_SUPERVISOR_CHILD"
+
+// TestSupervisorChild is the worker started by TestSupervisor. It replies its
+// pid to each connection.
+func TestSupervisorChild(t *testing.T) {
+	mode := os.Getenv(supervisorChildEnv)
+	if mode == "" {
+		t.Skip("run by TestSupervisor")
+	}
+
+	conn, err := SupervisorConn()
+	if err != nil {
+		t.Fatalf("SupervisorConn error: %v", err)
+	}
+	if mode == "crash" {
+		ReportReady(conn)
+		time.Sleep(10 * time.Millisecond)
+		os.Exit(1)
+	}
+	if mode == "stubborn" {
+		signal.Ignore(syscall.SIGTERM)
+		ReportReady(conn)
+		time.Sleep(time.Hour)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	go func() {
+		<-sig
+		os.Exit(0)
+	}()
+
+	ql := NewQueueListener(10)
+	go ql.Feed(conn)
+	if err := ReportReady(conn); err != nil {
+		t.Fatalf("ReportReady error: %v", err)
+	}
+	for {
+		c, err := ql.Accept()
+		if err != nil {
+			os.Exit(0)
+		}
+		c.Write([]byte(strconv.Itoa(os.Getpid()) + "\n"))
+		c.Close()
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	command := func(mode string) func(int) *exec.Cmd {
+		return func(int) *exec.Cmd {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSupervisorChild$")
+			cmd.Env = append(os.Environ(), supervisorChildEnv+"="+mode)
+			cmd.Stderr = os.Stderr
+			return cmd
+		}
+	}
+
+	t.Run("restart and rolling restart", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDispatcher(l)
+		defer d.Close()
+		go d.Serve()
+
+		s := &Supervisor{
+			N:           2,
+			Command:     command("serve"),
+			Dispatcher:  d,
+			MinBackoff:  time.Millisecond,
+			StopTimeout: 5 * time.Second,
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("Start error: %v", err)
+		}
+		defer s.Stop(context.Background())
+
+		pids := func() map[string]bool {
+			t.Helper()
+			ps := make(map[string]bool)
+			for i := 0; i < 4; i++ {
+				c, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Fatalf("Dial error: %v", err)
+				}
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				line, err := bufio.NewReader(c).ReadString('\n')
+				c.Close()
+				if err != nil {
+					t.Fatalf("read error: %v", err)
+				}
+				ps[line] = true
+			}
+			return ps
+		}
+		waitWorkers := func(n int) {
+			t.Helper()
+			for i := 0; len(d.Workers()) != n; i++ {
+				if i == 500 {
+					t.Fatalf("got %d workers but want %d", len(d.Workers()), n)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		before := pids()
+		if len(before) != 2 {
+			t.Fatalf("got %d workers replied but want 2", len(before))
+		}
+
+		// a crashed worker is restarted
+		s.m.Lock()
+		crashed := s.slots[0]
+		s.m.Unlock()
+		crashed.cmd.Process.Kill()
+		<-crashed.exited
+		waitWorkers(2)
+		if len(s.Conns()) != 2 {
+			t.Errorf("got %d connections but want 2", len(s.Conns()))
+		}
+
+		before = pids()
+		if err := s.RollingRestart(context.Background()); err != nil {
+			t.Fatalf("RollingRestart error: %v", err)
+		}
+		waitWorkers(2)
+		for pid := range pids() {
+			if before[pid] {
+				t.Errorf("worker %s not replaced", pid)
+			}
+		}
+
+		if err := s.Stop(context.Background()); err != nil {
+			t.Fatalf("Stop error: %v", err)
+		}
+		if err := s.Wait(); err != nil {
+			t.Errorf("Wait error: %v", err)
+		}
+		if n := len(d.Workers()); n != 0 {
+			t.Errorf("got %d workers after Stop", n)
+		}
+	})
+
+	t.Run("crash loop", func(t *testing.T) {
+		s := &Supervisor{
+			N:           1,
+			Command:     command("crash"),
+			MinBackoff:  time.Millisecond,
+			MaxRestarts: 2,
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("Start error: %v", err)
+		}
+		if err := s.Wait(); err != ErrCrashLoop {
+			t.Errorf("got error `%v` but want `%v`", err, ErrCrashLoop)
+		}
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		s := &Supervisor{
+			N: 1,
+			Command: func(int) *exec.Cmd {
+				return exec.Command("sleep", "10")
+			},
+			ReadyTimeout: 100 * time.Millisecond,
+		}
+		if err := s.Start(); err != ErrTimeout {
+			t.Errorf("got error `%v` but want `%v`", err, ErrTimeout)
+		}
+	})
+	t.Run("stubborn worker killed on start failure", func(t *testing.T) {
+		s := &Supervisor{
+			N: 2,
+			Command: func(i int) *exec.Cmd {
+				if i == 0 {
+					return command("stubborn")(i)
+				}
+				return exec.Command("sleep", "10")
+			},
+			ReadyTimeout: 2 * time.Second,
+			StopTimeout:  100 * time.Millisecond,
+		}
+		done := make(chan error)
+		go func() { done <- s.Start() }()
+		select {
+		case err := <-done:
+			if err != ErrTimeout {
+				t.Errorf("got error `%v` but want `%v`", err, ErrTimeout)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Start hangs")
+		}
+	})
+
+	t.Run("stop before start", func(t *testing.T) {
+		s := &Supervisor{N: 1, Command: command("")}
+		if err := s.Stop(context.Background()); err != nil {
+			t.Errorf("Stop error: %v", err)
+		}
+		if err := s.Wait(); err != nil {
+			t.Errorf("Wait error: %v", err)
+		}
+		if err := s.Start(); err == nil {
+			t.Errorf("Start after Stop succeeded")
+		}
+	})
+
+	t.Run("stop during restart", func(t *testing.T) {
+		var starts int32
+		s := &Supervisor{
+			N: 1,
+			Command: func(i int) *exec.Cmd {
+				if atomic.AddInt32(&starts, 1) == 1 {
+					return command("crash")(i)
+				}
+				return exec.Command("sleep", "10")
+			},
+			ReadyTimeout: 10 * time.Second,
+			MinBackoff:   time.Millisecond,
+		}
+		if err := s.Start(); err != nil {
+			t.Fatalf("Start error: %v", err)
+		}
+		for atomic.LoadInt32(&starts) < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		st := time.Now()
+		s.Stop(context.Background())
+		if elapsed := time.Since(st); elapsed > 5*time.Second {
+			t.Errorf("Stop waited for the restarting worker: elapsed %v", elapsed)
+		}
+	})
+}
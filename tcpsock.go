@@ -3,6 +3,8 @@ package ipc
 import (
 	"net"
 	"runtime"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +20,8 @@ type tcpConn struct {
 	laddr     net.TCPAddr
 	raddr     net.TCPAddr
 	peeked    []byte
+	info      *ConnInfo
+	closed    int32 // accessed atomically
 }
 
 func (c *tcpConn) Read(b []byte) (n int, err error) {
@@ -46,7 +50,12 @@ func (c *tcpConn) Write(b []byte) (n int, err error) {
 	return
 }
 
+// Close closes the socket. Closing twice does nothing, since the descriptor
+// may have been reused.
 func (c *tcpConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
 	runtime.SetFinalizer(c, nil)
 	return c.sysSocket.close()
 }
@@ -83,8 +92,42 @@ func (c *tcpConn) RemoteAddr() net.Addr {
 	return &c.raddr
 }
 
-func newTCPConn(ss *sysSocket, laddr, raddr net.TCPAddr, peeked []byte) TCPConn {
-	tcp := &tcpConn{ss, laddr, raddr, peeked}
+// SyscallConn returns a raw network connection; it implements the
+// syscall.Conn interface so that the connection can be passed again.
+func (c *tcpConn) SyscallConn() (syscall.RawConn, error) {
+	return &rawSocket{c.sysSocket}, nil
+}
+
+// rawSocket implements syscall.RawConn for sysSocket.
+type rawSocket struct {
+	s *sysSocket
+}
+
+func (r *rawSocket) Control(f func(fd uintptr)) error {
+	f(uintptr(r.s.fd))
+	return nil
+}
+
+func (r *rawSocket) Read(f func(fd uintptr) bool) error {
+	for !f(uintptr(r.s.fd)) {
+		if _, err := r.s.waitUntilReadable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rawSocket) Write(f func(fd uintptr) bool) error {
+	for !f(uintptr(r.s.fd)) {
+		if _, err := r.s.waitUntilWritable(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTCPConn(ss *sysSocket, laddr, raddr net.TCPAddr, peeked []byte, info *ConnInfo) TCPConn {
+	tcp := &tcpConn{sysSocket: ss, laddr: laddr, raddr: raddr, peeked: peeked, info: info}
 	runtime.SetFinalizer(tcp, (*tcpConn).Close)
 	return tcp
 }
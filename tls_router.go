@@ -0,0 +1,254 @@
+package ipc
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	// ErrNotClientHello is returned when the data is not a TLS ClientHello.
+	ErrNotClientHello = errors.New("not a TLS ClientHello")
+
+	// errIncompleteHello is returned by ParseClientHello when more data is
+	// needed.
+	errIncompleteHello = errors.New("incomplete TLS ClientHello")
+)
+
+// ClientHello is the routing information of a TLS ClientHello.
+type ClientHello struct {
+	// ServerName is the SNI host name; empty if the client did not send it.
+	ServerName string
+	// Protocols is the ALPN protocol names offered by the client.
+	Protocols []string
+}
+
+// DefaultMaxHelloBytes is the default limit of ReadClientHello.
+const DefaultMaxHelloBytes = 16 << 10
+
+// ReadClientHello reads a TLS ClientHello from conn without terminating TLS.
+// It reads at most max bytes within timeout; zero means DefaultMaxHelloBytes
+// and DefaultPeekTimeout respectively.
+//
+// The returned bytes are all data read from conn; pass them to the worker as
+// the peeked data so that the worker completes the handshake.
+func ReadClientHello(conn net.Conn, max int, timeout time.Duration) (*ClientHello, []byte, error) {
+	if max == 0 {
+		max = DefaultMaxHelloBytes
+	}
+	if timeout == 0 {
+		timeout = DefaultPeekTimeout
+	}
+
+	var hello *ClientHello
+	var perr error
+	peeked, err := peekConn(conn, max, timeout, func(b []byte) bool {
+		hello, perr = ParseClientHello(b)
+		return perr != errIncompleteHello
+	})
+	if err == errPeekTooLarge {
+		return nil, peeked, ErrNotClientHello
+	}
+	if perr != nil && perr != errIncompleteHello {
+		return nil, peeked, perr
+	}
+	if err != nil {
+		return nil, peeked, err
+	}
+	return hello, peeked, nil
+}
+
+// ParseClientHello parses a ClientHello from the TLS records in data. It
+// returns ErrNotClientHello if data is not a ClientHello.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	// reassemble the handshake message from the records
+	var msg []byte
+	for {
+		if len(data) < 5 {
+			return nil, errIncompleteHello
+		}
+		if data[0] != 22 || data[1] != 3 { // handshake, TLS 1.x
+			return nil, ErrNotClientHello
+		}
+		n := int(data[3])<<8 | int(data[4])
+		if len(data) < 5+n {
+			return nil, errIncompleteHello
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+
+		if len(msg) >= 4 {
+			if msg[0] != 1 { // client_hello
+				return nil, ErrNotClientHello
+			}
+			n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if len(msg) >= 4+n {
+				msg = msg[4 : 4+n]
+				break
+			}
+		}
+	}
+
+	p := helloParser{b: msg}
+	p.skip(2 + 32)       // client_version, random
+	p.skip(int(p.u8()))  // session_id
+	p.skip(int(p.u16())) // cipher_suites
+	p.skip(int(p.u8()))  // compression_methods
+	if p.err == nil && len(p.b) == 0 {
+		return &ClientHello{}, nil // no extensions
+	}
+
+	hello := &ClientHello{}
+	exts := helloParser{b: p.bytes(int(p.u16()))}
+	for p.err == nil && exts.err == nil && len(exts.b) > 0 {
+		typ := exts.u16()
+		ext := helloParser{b: exts.bytes(int(exts.u16()))}
+		switch typ {
+		case 0: // server_name
+			list := helloParser{b: ext.bytes(int(ext.u16()))}
+			for list.err == nil && len(list.b) > 0 {
+				nameType := list.u8()
+				name := list.bytes(int(list.u16()))
+				if nameType == 0 { // host_name
+					hello.ServerName = string(name)
+				}
+			}
+			if list.err != nil {
+				ext.err = list.err
+			}
+		case 16: // application_layer_protocol_negotiation
+			list := helloParser{b: ext.bytes(int(ext.u16()))}
+			for list.err == nil && len(list.b) > 0 {
+				proto := list.bytes(int(list.u8()))
+				if list.err == nil {
+					hello.Protocols = append(hello.Protocols, string(proto))
+				}
+			}
+			if list.err != nil {
+				ext.err = list.err
+			}
+		}
+		if ext.err != nil {
+			exts.err = ext.err
+		}
+	}
+	if p.err != nil || exts.err != nil {
+		return nil, ErrNotClientHello
+	}
+	return hello, nil
+}
+
+// helloParser reads big endian values from b; it sets err if b is too short.
+type helloParser struct {
+	b   []byte
+	err error
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.b) < n {
+		p.err = ErrNotClientHello
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *helloParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *helloParser) u8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *helloParser) u16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// TLSRoute routes TLS connections to the workers of Group.
+//
+// ServerName matches the SNI host name ignoring case; "*.example.com" matches
+// any subdomain of example.com. Protocol matches if the client offers it with
+// ALPN. Empty ServerName or Protocol matches any connection.
+type TLSRoute struct {
+	ServerName string
+	Protocol   string
+	Group      string
+}
+
+func (r *TLSRoute) match(hello *ClientHello) bool {
+	if r.ServerName != "" && !matchHost(r.ServerName, hello.ServerName) {
+		return false
+	}
+	if r.Protocol == "" {
+		return true
+	}
+	for _, p := range hello.Protocols {
+		if p == r.Protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSRouter selects a worker by the SNI and ALPN of TLS connections without
+// terminating TLS. The ClientHello read in Peek is passed to the worker as the
+// peeked data; the worker completes the handshake with its own certificate.
+// Use it with a Dispatcher:
+//
+//	d.Peek = router.Peek
+//	d.Balancer = router
+//
+// Routes are examined in order and the first match decides the group. If no
+// route matches, the group has no worker or the client did not send a
+// ClientHello, the connection is closed.
+type TLSRouter struct {
+	Routes []TLSRoute
+
+	// Balancer selects a worker in the group. If nil, RoundRobin is used.
+	Balancer Balancer
+
+	// MaxHelloBytes limits the size of the ClientHello. If zero,
+	// DefaultMaxHelloBytes is used.
+	MaxHelloBytes int
+
+	// Timeout limits the time to read the ClientHello. If zero,
+	// DefaultPeekTimeout is used.
+	Timeout time.Duration
+
+	roundRobin roundRobin
+}
+
+// Peek reads the ClientHello from conn. See Dispatcher.Peek.
+func (r *TLSRouter) Peek(conn net.Conn) ([]byte, error) {
+	_, peeked, err := ReadClientHello(conn, r.MaxHelloBytes, r.Timeout)
+	return peeked, err
+}
+
+// Pick implements the Balancer interface; it selects a worker of the group
+// routed by the ClientHello in peeked.
+func (r *TLSRouter) Pick(workers []*Worker, client *net.TCPAddr, peeked []byte) *Worker {
+	hello, err := ParseClientHello(peeked)
+	if err != nil {
+		return nil
+	}
+
+	for i := range r.Routes {
+		if r.Routes[i].match(hello) {
+			return pickGroup(r.Balancer, &r.roundRobin, r.Routes[i].Group, workers, client, peeked)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package ipc
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the ClientHello sent by crypto/tls.
+func clientHello(t *testing.T, serverName string, protos []string) []byte {
+	server, client := tcpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		c := tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: protos})
+		c.SetDeadline(time.Now().Add(time.Second))
+		c.Handshake()
+	}()
+
+	hello, peeked, err := ReadClientHello(server, 0, time.Second)
+	if err != nil {
+		t.Fatalf("ReadClientHello error: %v", err)
+	}
+	if got, want := hello.ServerName, serverName; got != want {
+		t.Errorf("got server name %q but want %q", got, want)
+	}
+	if got, want := len(hello.Protocols), len(protos); got != want {
+		t.Fatalf("got %v protocols but want %v", got, want)
+	}
+	for i := range protos {
+		if got, want := hello.Protocols[i], protos[i]; got != want {
+			t.Errorf("got protocol %q but want %q", got, want)
+		}
+	}
+	return peeked
+}
+
+func TestParseClientHello(t *testing.T) {
+	peeked := clientHello(t, "www.example.com", []string{"h2", "http/1.1"})
+
+	t.Run("fragmented records", func(t *testing.T) {
+		body := peeked[5:]
+		var data []byte
+		for i := 0; i < len(body); i += 100 {
+			end := i + 100
+			if end > len(body) {
+				end = len(body)
+			}
+			data = append(data, 22, 3, 1, byte((end-i)>>8), byte(end-i))
+			data = append(data, body[i:end]...)
+		}
+
+		if _, err := ParseClientHello(data[:len(data)-1]); err != errIncompleteHello {
+			t.Errorf("got error `%v` but want `%v`", err, errIncompleteHello)
+		}
+		hello, err := ParseClientHello(data)
+		if err != nil {
+			t.Fatalf("ParseClientHello error: %v", err)
+		}
+		if got, want := hello.ServerName, "www.example.com"; got != want {
+			t.Errorf("got server name %q but want %q", got, want)
+		}
+	})
+
+	t.Run("not TLS", func(t *testing.T) {
+		if _, err := ParseClientHello([]byte("GET / HTTP/1.1\r\n\r\n")); err != ErrNotClientHello {
+			t.Errorf("got error `%v` but want `%v`", err, ErrNotClientHello)
+		}
+	})
+
+	t.Run("broken extension", func(t *testing.T) {
+		// server_name extension whose list is longer than the extension
+		ext := []byte{0, 0, 0, 5, 0, 16, 0, 0, 1}
+		body := append([]byte{3, 3}, make([]byte, 32)...)
+		body = append(body, 0, 0, 2, 0x13, 0x01, 1, 0, 0, byte(len(ext)))
+		body = append(body, ext...)
+		msg := append([]byte{1, 0, 0, byte(len(body))}, body...)
+		data := append([]byte{22, 3, 1, 0, byte(len(msg))}, msg...)
+
+		if _, err := ParseClientHello(data); err != ErrNotClientHello {
+			t.Errorf("got error `%v` but want `%v`", err, ErrNotClientHello)
+		}
+	})
+}
+
+func TestTLSRouter(t *testing.T) {
+	ws := newTestingWorkers(3)
+	ws[0].SetGroup("a")
+	ws[1].SetGroup("b")
+	ws[2].SetGroup("h2")
+
+	r := &TLSRouter{
+		Routes: []TLSRoute{
+			{ServerName: "a.example.com", Group: "a"},
+			{ServerName: "*.example.net", Group: "b"},
+			{Protocol: "h2", Group: "h2"},
+		},
+	}
+
+	var tests = []struct {
+		name       string
+		serverName string
+		protos     []string
+		want       *Worker
+	}{
+		{"server name", "A.example.com", nil, ws[0]},
+		{"wildcard", "x.example.net", []string{"h2"}, ws[1]},
+		{"alpn", "c.example.com", []string{"http/1.1", "h2"}, ws[2]},
+		{"no route", "c.example.com", []string{"http/1.1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peeked := clientHello(t, tt.serverName, tt.protos)
+			got := r.Pick(ws, &net.TCPAddr{}, peeked)
+			if got != tt.want {
+				t.Errorf("got worker %v but want %v", got, tt.want)
+			}
+		})
+	}
+}
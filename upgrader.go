@@ -0,0 +1,355 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultReadyTimeout is the time the new process of Upgrader has to become
+// ready by default.
+const DefaultReadyTimeout = time.Minute
+
+// upgradeEnv is the environment variable telling the new process of an
+// Upgrader the descriptor of the IPC connection.
+const upgradeEnv = "GO_IPC_UPGRADE_FD"
+
+// Upgrader implements zero-downtime binary upgrades.
+//
+// The running process registers its listeners with Listen. On Upgrade, it
+// starts the new binary and hands the listeners over; the new process gets
+// them from Listen with the same names, and calls Ready when it is serving.
+// Then Exit is closed, and the old process stops accepting and drains. If the
+// new process fails to start or to become ready, Upgrade returns an error and
+// the old process keeps serving.
+//
+//	u, _ := ipc.NewUpgrader()
+//	l, _ := u.Listen("web", "tcp", ":8080")
+//	go srv.Serve(l)
+//	u.Ready()
+//	go func() {
+//		for range sighup {
+//			u.Upgrade()
+//		}
+//	}()
+//	<-u.Exit()
+//	srv.Shutdown(ctx)
+//
+// It is supported on linux only; Upgrade returns ErrNotSupported on windows.
+type Upgrader struct {
+	// ReadyTimeout limits the time the new process takes to call Ready. If
+	// zero, DefaultReadyTimeout is used.
+	ReadyTimeout time.Duration
+
+	// Command returns the command of the new process. If nil, the executable
+	// of the running process is started with the same arguments, environment
+	// and standard I/O.
+	Command func() (*exec.Cmd, error)
+
+	m         sync.Mutex // guard below
+	names     []string
+	listeners map[string]net.Listener
+	inherited map[string]net.Listener
+	parent    *Conn
+	ready     bool
+	upgrading bool
+
+	exit     chan struct{}
+	exitOnce sync.Once
+}
+
+// NewUpgrader creates an Upgrader. If the process is started by Upgrade, it
+// receives the listeners from the old process.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{
+		listeners: make(map[string]net.Listener),
+		inherited: make(map[string]net.Listener),
+		exit:      make(chan struct{}),
+	}
+
+	parent, err := fromParent(upgradeEnv)
+	if err == ErrNoParent {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u.parent = parent
+	if err := u.receiveListeners(); err != nil {
+		parent.Close()
+		for _, l := range u.inherited {
+			l.Close()
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// HasParent reports whether the process is started by Upgrade.
+func (u *Upgrader) HasParent() bool {
+	return u.parent != nil
+}
+
+// Listen returns the listener of the name handed over from the old process,
+// or announces on the address if there is none.
+func (u *Upgrader) Listen(name, network, address string) (net.Listener, error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if _, ok := u.listeners[name]; ok {
+		return nil, fmt.Errorf("listener %q already registered", name)
+	}
+
+	l, ok := u.inherited[name]
+	if ok {
+		delete(u.inherited, name)
+	} else {
+		var err error
+		if l, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+
+	u.names = append(u.names, name)
+	u.listeners[name] = l
+	return l, nil
+}
+
+// Ready tells the old process that this process is serving. The listeners
+// handed over but not taken with Listen are closed.
+func (u *Upgrader) Ready() error {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if u.ready {
+		return nil
+	}
+	u.ready = true
+
+	for name, l := range u.inherited {
+		l.Close()
+		delete(u.inherited, name)
+	}
+	if u.parent == nil {
+		return nil
+	}
+
+	err := u.parent.sendMessage(&upgradeMessage{Kind: upgradeReady})
+	u.parent.Close()
+	u.parent = nil
+	return err
+}
+
+// Exit returns a channel closed when an upgrade has succeeded; the process
+// should stop accepting and exit after draining.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.exit
+}
+
+// Close closes the registered listeners.
+func (u *Upgrader) Close() error {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	var err error
+	for _, name := range u.names {
+		if cerr := u.listeners[name].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Upgrade starts the new process, hands the listeners over, and waits until
+// it becomes ready. It returns nil and closes Exit on success. Otherwise the
+// new process is killed, and the listeners are kept serving.
+//
+// The process must have called Ready before Upgrade.
+func (u *Upgrader) Upgrade() error {
+	u.m.Lock()
+	if u.upgrading {
+		u.m.Unlock()
+		return ErrUpgradeInProgress
+	}
+	if !u.ready {
+		u.m.Unlock()
+		return ErrNotReady
+	}
+	u.upgrading = true
+	names := append([]string(nil), u.names...)
+	listeners := make(map[string]net.Listener, len(u.listeners))
+	for name, l := range u.listeners {
+		listeners[name] = l
+	}
+	u.m.Unlock()
+
+	defer func() {
+		u.m.Lock()
+		u.upgrading = false
+		u.m.Unlock()
+	}()
+
+	cmd, err := u.command()
+	if err != nil {
+		return err
+	}
+	c, err := startChild(cmd, upgradeEnv)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := u.upgrade(c, names, listeners); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	go cmd.Wait()
+
+	// the socket files are owned by the new process now
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	u.exitOnce.Do(func() { close(u.exit) })
+	return nil
+}
+
+func (u *Upgrader) upgrade(c *Conn, names []string, listeners map[string]net.Listener) error {
+	for _, name := range names {
+		l := listeners[name]
+		sc, ok := l.(syscall.Conn)
+		if !ok {
+			return fmt.Errorf("unsupported listener %T", l)
+		}
+		if err := c.sendListener(l, sc, []byte(name)); err != nil {
+			return err
+		}
+	}
+	if err := c.sendMessage(&upgradeMessage{Kind: upgradeDone}); err != nil {
+		return err
+	}
+
+	timeout := u.ReadyTimeout
+	if timeout == 0 {
+		timeout = DefaultReadyTimeout
+	}
+	result := make(chan error, 1)
+	go func() { result <- waitUpgradeReady(c) }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+func waitUpgradeReady(c *Conn) error {
+	cmd, err := c.ReceiveCommand()
+	if err == io.EOF {
+		return errors.New("new process exited before ready")
+	}
+	if err != nil {
+		return err
+	}
+	if cmd != DataCommand {
+		return errors.New("unexpected command " + cmd.String())
+	}
+
+	var m upgradeMessage
+	if err := c.receiveMessage(&m); err != nil {
+		return err
+	}
+	if m.Kind != upgradeReady {
+		return fmt.Errorf("unexpected upgrade message %d", m.Kind)
+	}
+	return nil
+}
+
+func (u *Upgrader) command() (*exec.Cmd, error) {
+	if u.Command != nil {
+		return u.Command()
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	// the binary may have been replaced by the new one
+	exe = strings.TrimSuffix(exe, " (deleted)")
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// receiveListeners receives the listeners from the old process.
+func (u *Upgrader) receiveListeners() error {
+	c := u.parent
+	for {
+		cmd, err := c.ReceiveCommand()
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case ListenerCommand:
+			l, withData, err := c.ReceiveListener()
+			if err != nil {
+				return err
+			}
+			if !withData {
+				l.Close()
+				return errors.New("listener without name")
+			}
+			name, err := c.ReceiveData()
+			if err != nil {
+				l.Close()
+				return err
+			}
+			u.inherited[string(name)] = l
+		case DataCommand:
+			var m upgradeMessage
+			if err := c.receiveMessage(&m); err != nil {
+				return err
+			}
+			if m.Kind == upgradeDone {
+				return nil
+			}
+		default:
+			return errors.New("unexpected command " + cmd.String())
+		}
+	}
+}
+
+const (
+	upgradeDone = iota + 1
+	upgradeReady
+)
+
+type upgradeMessage struct {
+	Kind uint8
+}
+
+func (m *upgradeMessage) serialize(w io.Writer) error {
+	bw := &bytesWriter{w, nil}
+	bw.write(m.Kind)
+	return bw.err
+}
+
+func (m *upgradeMessage) deserialize(r io.Reader) error {
+	br := &bytesReader{r, nil}
+	br.read(&m.Kind)
+	return br.err
+}
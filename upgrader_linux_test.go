@@ -0,0 +1,125 @@
+package ipc
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const upgraderChildEnv = "GO_IPC_TEST_UPGRADER_CHILD"
+
+// TestUpgraderChild is the new process started by TestUpgrader.
+func TestUpgraderChild(t *testing.T) {
+	mode := os.Getenv(upgraderChildEnv)
+	if mode == "" {
+		t.Skip("run by TestUpgrader")
+	}
+	if mode == "fail" {
+		os.Exit(1)
+	}
+
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatalf("NewUpgrader error: %v", err)
+	}
+	if !u.HasParent() {
+		t.Fatal("got no parent")
+	}
+	l, err := u.Listen("web", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer u.Close()
+	if err := u.Ready(); err != nil {
+		t.Fatalf("Ready error: %v", err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error: %v", err)
+	}
+	conn.Write([]byte("new\n"))
+	conn.Close()
+}
+
+func TestUpgrader(t *testing.T) {
+	command := func(mode string) func() (*exec.Cmd, error) {
+		return func() (*exec.Cmd, error) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestUpgraderChild$")
+			cmd.Env = append(os.Environ(), upgraderChildEnv+"="+mode)
+			cmd.Stderr = os.Stderr
+			return cmd, nil
+		}
+	}
+
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatalf("NewUpgrader error: %v", err)
+	}
+	defer u.Close()
+	l, err := u.Listen("web", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+
+	if err := u.Upgrade(); err != ErrNotReady {
+		t.Errorf("got error `%v` but want `%v`", err, ErrNotReady)
+	}
+	if err := u.Ready(); err != nil {
+		t.Fatalf("Ready error: %v", err)
+	}
+
+	t.Run("new process fails", func(t *testing.T) {
+		u.Command = command("fail")
+		if err := u.Upgrade(); err == nil {
+			t.Fatal("Upgrade succeeded")
+		}
+		select {
+		case <-u.Exit():
+			t.Fatal("Exit closed")
+		default:
+		}
+
+		// the old process keeps serving
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				c.Close()
+			}
+		}()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial error: %v", err)
+		}
+		c.Close()
+	})
+
+	t.Run("new process takes over", func(t *testing.T) {
+		u.Command = command("serve")
+		u.ReadyTimeout = 30 * time.Second
+		if err := u.Upgrade(); err != nil {
+			t.Fatalf("Upgrade error: %v", err)
+		}
+		select {
+		case <-u.Exit():
+		default:
+			t.Fatal("Exit not closed")
+		}
+		u.Close()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial error: %v", err)
+		}
+		defer c.Close()
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if line != "new\n" {
+			t.Errorf("got %q but want %q", line, "new\n")
+		}
+	})
+}